@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+var relisten = flag.Duration("relisten", 0, "on the entry, when the listener fails for good, open it again after this long instead of exiting (0 = exit)")
+
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// acceptRetry decides what runEntry does after ln.Accept failed. Temporary
+// errors (EMFILE, ENFILE, ECONNABORTED...) sleep with a backoff that
+// doubles up to acceptBackoffMax and is reset by the next successful
+// accept. Anything else means the listener is dead: with -relisten it is
+// replaced once a new one can be opened, otherwise ok is false and the
+// accept loop should stop.
+func acceptRetry(ln net.Listener, err error, backoff *time.Duration) (_ net.Listener, ok bool) {
+	var te interface{ Temporary() bool }
+	if errors.As(err, &te) && te.Temporary() {
+		*backoff = min(max(2**backoff, acceptBackoffMin), acceptBackoffMax)
+		log.Println("[ENTRY] Accept error, retrying in", *backoff, "-", err)
+		time.Sleep(*backoff)
+		return ln, true
+	}
+	if *relisten <= 0 || errors.Is(err, net.ErrClosed) {
+		log.Println("[ENTRY] Accept error, stopping:", err)
+		return ln, false
+	}
+
+	log.Println("[ENTRY] Listener failed, reopening in", *relisten, "-", err)
+	_ = ln.Close()
+	for {
+		time.Sleep(*relisten)
+		nl, err := listen(*entryListenAddr)
+		if err == nil {
+			log.Println("[ENTRY] Listening again on", nl.Addr())
+			*backoff = 0
+			return nl, true
+		}
+		log.Println("[ENTRY] Reopen listener:", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mc-ws-proxy/proxy"
+)
+
+var adminAddr = flag.String("admin-addr", "", "listen address for the admin HTTP API, e.g. 127.0.0.1:9090 or unix:/run/mc-ws-proxy-admin.sock (empty = disabled)")
+
+// connInfo describes one player connection while its bridge is running.
+type connInfo struct {
+	ID      uint64
+	Mode    string
+	Remote  string
+	Backend string
+	Start   time.Time
+
+	proxy.Counters
+
+	peerStats atomic.Pointer[peerStats] // last -stats-channel frame from the exit
+	rtt       atomic.Int64              // last -e2e-rtt round trip, ns; 0 = none yet
+
+	statusSniff *statusSniffer // entry: status ping to fill -status-cache-ttl from
+
+	// For connTotals, under connRegistry's lock.
+	counted               bool
+	countedWS, countedTCP int64
+
+	cancel context.CancelFunc // set by the bridge
+}
+
+var lastConnID atomic.Uint64
+
+func newConnInfo(mode, remote, backend string) *connInfo {
+	return &connInfo{
+		ID:      lastConnID.Add(1),
+		Mode:    mode,
+		Remote:  remote,
+		Backend: backend,
+		Start:   time.Now(),
+	}
+}
+
+// connRegistry holds the active bridges, keyed by connection ID.
+var connRegistry = struct {
+	sync.Mutex
+	conns map[uint64]*connInfo
+}{conns: make(map[uint64]*connInfo)}
+
+func registerConn(c *connInfo, cancel context.CancelFunc) {
+	connRegistry.Lock()
+	c.cancel = cancel
+	connRegistry.conns[c.ID] = c
+	countRegistered(c)
+	connRegistry.Unlock()
+}
+
+func unregisterConn(c *connInfo) {
+	connRegistry.Lock()
+	delete(connRegistry.conns, c.ID)
+	countUnregistered(c)
+	connRegistry.Unlock()
+}
+
+// errAdminClose is the cancellation cause of a bridge closed through
+// POST /connections/{id}/close; the peer sees it as the close reason.
+var errAdminClose = errors.New("closed-by-admin")
+
+type connJSON struct {
+	ID         uint64     `json:"id"`
+	Mode       string     `json:"mode"`
+	Remote     string     `json:"remote"`
+	Backend    string     `json:"backend"`
+	Start      time.Time  `json:"start"`
+	BytesToWS  int64      `json:"bytes_to_ws"`
+	BytesToTCP int64      `json:"bytes_to_tcp"`
+	PeerStats  *peerStats `json:"peer_stats,omitempty"`
+	RTTMillis  float64    `json:"e2e_rtt_ms,omitempty"` // last -e2e-rtt measurement
+
+	BackendDraining bool `json:"backend_draining,omitempty"` // entry: its -ws backend is being drained
+}
+
+func runAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", handleAdminConnections)
+	mux.HandleFunc("/connections/", handleAdminCloseConn)
+	mux.HandleFunc("/backends", handleAdminBackends)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	var ln net.Listener
+	var err error
+	if network, address := splitNetAddr(*adminAddr); network == "unix" {
+		ln, err = listenUnix(address)
+	} else {
+		ln, err = listenFunc(context.Background(), new(net.ListenConfig), network, address)
+	}
+	if err != nil {
+		log.Fatal("[ADMIN] listen error:", err)
+	}
+	log.Printf("[ADMIN] Listening on %s\n", ln.Addr())
+	// The backend URL in /backends/{url}/drain has a "//" that ServeMux
+	// would redirect away, so those requests are routed before it.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/backends/") {
+			handleAdminBackendDrain(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	if err := http.Serve(ln, handler); err != nil {
+		log.Fatal("[ADMIN] Serve error:", err)
+	}
+}
+
+// handleAdminConnections serves GET /connections.
+func handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	connRegistry.Lock()
+	list := make([]connJSON, 0, len(connRegistry.conns))
+	for _, c := range connRegistry.conns {
+		list = append(list, connJSON{
+			ID:         c.ID,
+			Mode:       c.Mode,
+			Remote:     c.Remote,
+			Backend:    c.Backend,
+			Start:      c.Start,
+			BytesToWS:  c.ToWS.Load(),
+			BytesToTCP: c.ToTCP.Load(),
+			PeerStats:  c.peerStats.Load(),
+			RTTMillis:  float64(c.rtt.Load()) / float64(time.Millisecond),
+
+			BackendDraining: c.Mode == "entry" && backendDraining(c.Backend),
+		})
+	}
+	connRegistry.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// handleAdminCloseConn serves POST /connections/{id}/close.
+func handleAdminCloseConn(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/connections/")
+	idStr, ok := strings.CutSuffix(rest, "/close")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	connRegistry.Lock()
+	c := connRegistry.conns[id]
+	connRegistry.Unlock()
+	if c == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[ADMIN] Closing connection %d (%s %s)", c.ID, c.Mode, c.Remote)
+	c.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+var backendAffinity = flag.String("backend-affinity", "none", "with several -ws backends, how to choose one for a player: none (round robin) | ip (the same player IP keeps going to the same usable backend; round robin if it cannot take the player)")
+
+///////////////////////
+//  入口机：后端亲和性（同一 IP 固定到同一后端）
+///////////////////////
+
+func checkBackendAffinity() error {
+	switch *backendAffinity {
+	case "none":
+	case "ip":
+		if *wsPoolSize > 0 {
+			return fmt.Errorf("-backend-affinity ip does not work with -ws-pool-size: pooled connections are dialed before the player is known")
+		}
+	default:
+		return fmt.Errorf("-backend-affinity must be none or ip, got %q", *backendAffinity)
+	}
+	return nil
+}
+
+// affinityKey is what -backend-affinity hashes for player, or "" for
+// round robin.
+func affinityKey(player net.Addr) string {
+	if *backendAffinity != "ip" || player == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(player.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// pickBackendFor picks the backend for key by rendezvous hashing: every
+// usable backend gets a score from key and its URL, and the highest wins.
+// A backend that goes away only moves the players it had; the others
+// keep theirs. An empty key, or a winner that turns the player down after
+// all (its half-open trial was just taken), falls back to pickBackend.
+func pickBackendFor(key string) (*backend, error) {
+	if key == "" || len(backends) == 1 {
+		return pickBackend()
+	}
+	now := time.Now()
+	var best *backend
+	var bestScore uint64
+	for _, b := range backends {
+		if !b.usable(now) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(b.URL))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	if best != nil && best.acquire(now) {
+		return best, nil
+	}
+	return pickBackend()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	targetAllowlist = flag.String("target-allowlist", "", "on the exit, comma-separated host:port, IP:port or CIDR entries; the TCP target is only dialed if it matches one (CIDR and IP entries are checked against the resolved address)")
+	dynamicTarget   = flag.String("dynamic-target", "", "on the exit, take the TCP target host:port from this upgrade request header (e.g. X-MC-Target) instead of -exit-target; needs -target-allowlist")
+)
+
+var errTargetNotAllowed = errors.New("target not in -target-allowlist")
+
+// targetAllow is the parsed -target-allowlist. A nil *targetAllow allows
+// everything.
+type targetAllow struct {
+	names    map[string]bool // host:port (or unix:path) exactly as dialed
+	addrs    map[netip.AddrPort]bool
+	prefixes []netip.Prefix
+}
+
+var allowedTargets *targetAllow
+
+func loadTargetAllowlist() error {
+	items := splitList(*targetAllowlist)
+	if len(items) == 0 {
+		if *dynamicTarget != "" && *mode == "exit" {
+			return errors.New("-dynamic-target needs -target-allowlist")
+		}
+		return nil
+	}
+	a := &targetAllow{names: make(map[string]bool), addrs: make(map[netip.AddrPort]bool)}
+	for _, item := range items {
+		if p, err := netip.ParsePrefix(item); err == nil {
+			a.prefixes = append(a.prefixes, p.Masked())
+			continue
+		}
+		if ap, err := netip.ParseAddrPort(item); err == nil {
+			a.addrs[unmapAddrPort(ap)] = true
+			continue
+		}
+		if strings.HasPrefix(item, "unix:") {
+			a.names[item] = true
+			continue
+		}
+		if host, _, err := net.SplitHostPort(item); err != nil || host == "" {
+			return fmt.Errorf("-target-allowlist: %q is not host:port, IP:port or a CIDR", item)
+		}
+		a.names[strings.ToLower(item)] = true
+	}
+	allowedTargets = a
+	if *dynamicTarget != "" {
+		return nil
+	}
+
+	// A literal -exit-target that can never match is a configuration error,
+	// not something to find out from the first player.
+	if ap, err := netip.ParseAddrPort(*exitTargetAddr); err == nil && *mode == "exit" && !a.allowsAddr(ap) {
+		return fmt.Errorf("-exit-target %s is not in -target-allowlist", *exitTargetAddr)
+	}
+	return nil
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (a *targetAllow) allowsName(addr string) bool {
+	return a.names[strings.ToLower(addr)]
+}
+
+func (a *targetAllow) allowsAddr(ap netip.AddrPort) bool {
+	ap = unmapAddrPort(ap)
+	if a.addrs[ap] {
+		return true
+	}
+	for _, p := range a.prefixes {
+		if p.Contains(ap.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// control is the net.Dialer hook that checks the address actually being
+// connected after name resolution, so a hostname target cannot be pointed
+// somewhere else through DNS.
+func (a *targetAllow) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil || !a.allowsAddr(ap) {
+		return fmt.Errorf("%w: %s", errTargetNotAllowed, address)
+	}
+	return nil
+}
+
+// requestTarget returns the TCP target for an upgrade request: the
+// -dynamic-target header when that is on, -exit-target otherwise. A header
+// that is missing, malformed or names a literal address outside the
+// allowlist is refused here, before the upgrade; hostnames are checked
+// against the allowlist again when dialed.
+func requestTarget(r *http.Request) (string, error) {
+	if *dynamicTarget == "" {
+		return *exitTargetAddr, nil
+	}
+	target := strings.TrimSpace(r.Header.Get(*dynamicTarget))
+	if target == "" {
+		return "", fmt.Errorf("missing %s header", *dynamicTarget)
+	}
+	if allowedTargets.allowsName(target) {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return "", fmt.Errorf("%s header %q is not host:port", *dynamicTarget, target)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("%s header %q has a bad port", *dynamicTarget, target)
+	}
+	if ap, err := netip.ParseAddrPort(target); err == nil && !allowedTargets.allowsAddr(ap) {
+		return "", fmt.Errorf("%w: %s", errTargetNotAllowed, target)
+	}
+	return target, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"net/http"
+)
+
+var (
+	exitBasicUser = flag.String("exit-basic-user", "", "require HTTP Basic auth with this user on the exit upgrade")
+	exitBasicPass = flag.String("exit-basic-pass", "", "password for -exit-basic-user")
+	wsBasicUser   = flag.String("ws-basic-user", "", "send HTTP Basic auth with this user when dialing -ws")
+	wsBasicPass   = flag.String("ws-basic-pass", "", "password for -ws-basic-user")
+	authToken     = flag.String("auth-token", "", "shared secret: the entry sends it in the "+authTokenHeader+" header when dialing -ws, and the exit refuses upgrades without it")
+)
+
+// authTokenHeader carries -auth-token on the upgrade request.
+const authTokenHeader = "X-Mcws-Token"
+
+// checkExitBasicAuth enforces -exit-basic-user/-exit-basic-pass and writes
+// the 401 itself. It reports whether the request may be upgraded.
+func checkExitBasicAuth(w http.ResponseWriter, r *http.Request) bool {
+	if *exitBasicUser == "" && *exitBasicPass == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	// Compare both fields even when the first one fails, to keep timing flat.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(*exitBasicUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(*exitBasicPass)) == 1
+	if ok && userOK && passOK {
+		return true
+	}
+	reject(rejectAuth, "[EXIT]", "Basic auth failed from", clientAddr(r))
+	w.Header().Set("WWW-Authenticate", `Basic realm="mc-ws-proxy"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// checkAuthToken enforces -auth-token on the exit and writes the 401
+// itself. It reports whether the request may be upgraded.
+func checkAuthToken(w http.ResponseWriter, r *http.Request) bool {
+	if *authToken == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(authTokenHeader)), []byte(*authToken)) == 1 {
+		return true
+	}
+	reject(rejectAuth, "[EXIT]", "auth token mismatch from", clientAddr(r))
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	breakerThreshold = flag.Int("breaker-threshold", 0, "with several -ws backends, skip a backend after this many consecutive dial failures (0 = never skip)")
+	breakerCooldown  = flag.Duration("breaker-cooldown", 30*time.Second, "how long a backend skipped by -breaker-threshold rests before one trial connection is let through")
+)
+
+///////////////////////
+//  入口机：多个 WebSocket 后端（轮询 + 熔断）
+///////////////////////
+
+// Circuit breaker states of a backend.
+const (
+	breakerClosed   = "closed"    // healthy, used normally
+	breakerOpen     = "open"      // skipped until openUntil
+	breakerHalfOpen = "half-open" // one trial dial in flight
+)
+
+var errNoBackend = errors.New("every -ws backend is unhealthy or draining, not dialing")
+
+// backend is one -ws URL with its circuit breaker.
+type backend struct {
+	URL string
+
+	// draining is set by POST /backends/{url}/drain: new connections skip
+	// the backend, the ones already bridged to it carry on.
+	draining atomic.Bool
+
+	status atomic.Pointer[cachedStatus] // latest status response, for -status-cache-ttl
+
+	mu        sync.Mutex
+	state     string
+	fails     int // consecutive dial failures
+	openUntil time.Time
+}
+
+// backends is -ws split at commas, in order. nextBackend rotates through it.
+var (
+	backends    []*backend
+	nextBackend atomic.Uint64
+)
+
+func parseBackends() error {
+	urls := splitList(*entryWsServerURL)
+	if len(urls) == 0 {
+		return fmt.Errorf("-ws is empty")
+	}
+	backends = backends[:0]
+	for _, u := range urls {
+		backends = append(backends, &backend{URL: u, state: breakerClosed})
+	}
+	return nil
+}
+
+// pickBackend returns the next usable backend in round-robin order. An open
+// breaker whose cooldown has passed lets exactly one caller through as the
+// trial; everyone else skips it until that trial reports back.
+func pickBackend() (*backend, error) {
+	start := nextBackend.Add(1) - 1
+	now := time.Now()
+	for i := range backends {
+		b := backends[(start+uint64(i))%uint64(len(backends))]
+		if b.acquire(now) {
+			return b, nil
+		}
+	}
+	return nil, errNoBackend
+}
+
+func (b *backend) acquire(now time.Time) bool {
+	if b.draining.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// report records the outcome of a dial to b.
+func (b *backend) report(err error) {
+	if *breakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Println("[ENTRY] Backend", b.URL, "is reachable again")
+		}
+		b.state, b.fails = breakerClosed, 0
+		return
+	}
+	b.fails++
+	switch {
+	case b.state == breakerHalfOpen:
+		log.Printf("[ENTRY] Trial connection to backend %s failed, skipping it for another %v", b.URL, *breakerCooldown)
+	case b.state == breakerClosed && b.fails >= *breakerThreshold:
+		log.Printf("[ENTRY] Backend %s failed %d times in a row, skipping it for %v", b.URL, b.fails, *breakerCooldown)
+	default:
+		return
+	}
+	b.state = breakerOpen
+	b.openUntil = time.Now().Add(*breakerCooldown)
+}
+
+func anyBackendHealthy() bool {
+	now := time.Now()
+	for _, b := range backends {
+		if b.usable(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// usable reports whether b would take a new connection, without claiming
+// a half-open trial the way acquire does.
+func (b *backend) usable(now time.Time) bool {
+	if b.draining.Load() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerOpen || !now.Before(b.openUntil)
+}
+
+type backendJSON struct {
+	URL                 string     `json:"url"`
+	Healthy             bool       `json:"healthy"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+	Draining            bool       `json:"draining"`
+	Connections         int        `json:"connections"` // bridged to it right now
+}
+
+func backendStatus() []backendJSON {
+	conns := make(map[string]int)
+	connRegistry.Lock()
+	for _, c := range connRegistry.conns {
+		conns[c.Backend]++
+	}
+	connRegistry.Unlock()
+
+	list := make([]backendJSON, 0, len(backends))
+	for _, b := range backends {
+		b.mu.Lock()
+		j := backendJSON{URL: b.URL, Healthy: b.state == breakerClosed, State: b.state, ConsecutiveFailures: b.fails, Draining: b.draining.Load(), Connections: conns[b.URL]}
+		if b.state == breakerOpen {
+			t := b.openUntil
+			j.RetryAt = &t
+		}
+		b.mu.Unlock()
+		list = append(list, j)
+	}
+	return list
+}
+
+// handleAdminBackends serves GET /backends.
+func handleAdminBackends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(backendStatus())
+}
+
+func findBackend(url string) *backend {
+	for _, b := range backends {
+		if b.URL == url {
+			return b
+		}
+	}
+	return nil
+}
+
+func backendDraining(url string) bool {
+	b := findBackend(url)
+	return b != nil && b.draining.Load()
+}
+
+// handleAdminBackendDrain serves POST /backends/{url}/drain and
+// /backends/{url}/undrain. The URL is the -ws entry as listed by
+// GET /backends, percent-encoded or not. It is taken from the raw path
+// because ServeMux would redirect the "//" in an unencoded one.
+func handleAdminBackendDrain(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/backends/")
+	drain := true
+	key, ok := strings.CutSuffix(rest, "/drain")
+	if !ok {
+		drain = false
+		key, ok = strings.CutSuffix(rest, "/undrain")
+	}
+	url, err := neturl.PathUnescape(key)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := findBackend(url)
+	if b == nil {
+		http.Error(w, "no such backend", http.StatusNotFound)
+		return
+	}
+	if b.draining.Swap(drain) != drain {
+		if drain {
+			log.Println("[ADMIN] Draining backend", b.URL+": new connections will skip it")
+			entryPool.evictBackend(b.URL)
+		} else {
+			log.Println("[ADMIN] Backend", b.URL, "is taking new connections again")
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
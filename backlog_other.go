@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// setListenBacklog does nothing here: listen(2) cannot be called again to
+// change the queue length.
+func setListenBacklog(ln net.Listener, n int) error {
+	return nil
+}
+
+const listenBacklogSupported = false
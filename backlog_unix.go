@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setListenBacklog calls listen(2) again on ln's socket with backlog n.
+// Linux, macOS and the BSDs take that on a listening socket as a change of
+// its queue length; the kernel still caps it at somaxconn. Listeners
+// without a socket (tests) are left alone.
+func setListenBacklog(ln net.Listener, n int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	err = rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), n)
+	})
+	if err != nil {
+		return err
+	}
+	return lerr
+}
+
+const listenBacklogSupported = true
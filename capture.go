@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var captureFile = flag.String("capture-file", "", "append every forwarded chunk, timestamped and tagged with connection and direction, to this binary file for offline analysis (see README for the format)")
+
+///////////////////////
+//  抓包文件（-capture-file）
+///////////////////////
+
+const (
+	captureMagic         = "MCWSCAP1"
+	captureFlushInterval = time.Second
+	captureBufferSize    = 256 * 1024
+	captureMaxRecord     = 64 << 20 // larger lengths can only come from a corrupt file
+)
+
+// Record directions.
+const (
+	captureToWS  = 0 // read from TCP, sent over the WebSocket
+	captureToTCP = 1 // received over the WebSocket, written to TCP
+)
+
+// capture is the open -capture-file. Records go into a buffer that is
+// flushed every captureFlushInterval, so the data path only ever waits on
+// the disk when the buffer fills up.
+var capture struct {
+	sync.Mutex
+	w *bufio.Writer
+}
+
+func openCapture() error {
+	if *captureFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*captureFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	capture.w = bufio.NewWriterSize(f, captureBufferSize)
+	if st.Size() == 0 {
+		_, _ = capture.w.WriteString(captureMagic)
+	}
+	go func() {
+		for range time.Tick(captureFlushInterval) {
+			capture.Lock()
+			err := capture.w.Flush()
+			capture.Unlock()
+			if err != nil {
+				log.Println("capture file:", err)
+			}
+		}
+	}()
+	log.Println("Capturing forwarded data to", *captureFile)
+	return nil
+}
+
+// captureHeaderSize is the fixed part of a record:
+// time (int64 Unix ns) | conn ID (uint64) | direction (uint8) | length (uint32).
+const captureHeaderSize = 21
+
+// captureRecord appends one record: the header above, then the data.
+func captureRecord(connID uint64, dir byte, data []byte) {
+	var hdr [captureHeaderSize]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(hdr[8:], connID)
+	hdr[16] = dir
+	binary.BigEndian.PutUint32(hdr[17:], uint32(len(data)))
+
+	capture.Lock()
+	_, _ = capture.w.Write(hdr[:])
+	_, _ = capture.w.Write(data)
+	capture.Unlock()
+}
+
+// captureRec is one record read back from a capture file.
+type captureRec struct {
+	Time   int64 // Unix ns
+	ConnID uint64
+	Dir    byte
+	Data   []byte
+}
+
+// readCapture reads every record of a capture file. A record cut short at
+// the end, as left by a process killed mid-write, is dropped with a
+// warning rather than failing the whole file.
+func readCapture(path string) ([]captureRec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		return nil, fmt.Errorf("%s is not a capture file", path)
+	}
+	var recs []captureRec
+	var hdr [captureHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Println(path + ": ignoring truncated record at the end")
+			} else if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			return recs, nil
+		}
+		n := binary.BigEndian.Uint32(hdr[17:])
+		if n > captureMaxRecord {
+			return nil, fmt.Errorf("%s: record of %d bytes after %d records, file is corrupt", path, n, len(recs))
+		}
+		rec := captureRec{
+			Time:   int64(binary.BigEndian.Uint64(hdr[0:])),
+			ConnID: binary.BigEndian.Uint64(hdr[8:]),
+			Dir:    hdr[16],
+			Data:   make([]byte, n),
+		}
+		if _, err := io.ReadFull(r, rec.Data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Println(path + ": ignoring truncated record at the end")
+				return recs, nil
+			}
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
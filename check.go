@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
+)
+
+var (
+	checkOnly = flag.Bool("check", false, "dial -ws once with the entry settings, report the result and exit (non-zero on failure)")
+	checkEcho = flag.Bool("check-echo", true, "with -check, also round-trip a WebSocket ping through the exit")
+)
+
+const checkTimeout = 10 * time.Second
+
+// runCheck verifies that the entry can reach its exit using exactly the same
+// dial path as a player connection (TLS, -dial-proxy, -auth-token and the
+// other upgrade headers included), without opening the listener. With
+// several -ws backends each one is checked.
+func runCheck() int {
+	failed := 0
+	for _, b := range backends {
+		if !checkBackend(b.URL) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		if len(backends) > 1 {
+			log.Printf("[CHECK] %d of %d backends failed", failed, len(backends))
+		}
+		return 1
+	}
+	log.Println("[CHECK] OK")
+	return 0
+}
+
+func checkBackend(wsURL string) bool {
+	start := time.Now()
+	ws, err := dialURL(context.Background(), wsURL, backendHeader())
+	if err != nil {
+		log.Println("[CHECK] Dial WS backend", wsURL, dialErrKind(err)+":", err)
+		return false
+	}
+	defer ws.Close()
+	via := ""
+	if dialProxyURL != nil {
+		via = " via " + dialProxyURL.Redacted()
+	}
+	log.Printf("[CHECK] Connected to %s%s in %s", wsURL, via, time.Since(start).Round(time.Millisecond))
+
+	if *checkEcho {
+		rtt, err := checkPing(ws)
+		if err != nil {
+			log.Println("[CHECK] Ping error:", err)
+			return false
+		}
+		log.Println("[CHECK] Ping round trip", rtt.Round(time.Millisecond))
+	}
+
+	_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(proxy.CloseWait))
+	return true
+}
+
+func checkPing(ws *websocket.Conn) (time.Duration, error) {
+	pong := make(chan struct{}, 1)
+	ws.SetPongHandler(func(string) error {
+		select {
+		case pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	readErr := make(chan error, 1)
+	go func() {
+		// Pong handlers only run while reading.
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	if err := ws.WriteControl(websocket.PingMessage, []byte("mc-ws-proxy check"), start.Add(checkTimeout)); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(checkTimeout)
+	defer timer.Stop()
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case err := <-readErr:
+		return 0, fmt.Errorf("connection closed before pong: %w", err)
+	case <-timer.C:
+		return 0, errors.New("no pong within " + checkTimeout.String())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+
+	"mc-ws-proxy/proxy"
+)
+
+// prefixConn replays bytes that were already read from the connection (for
+// example while parsing the handshake) before reading from it again.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func newPrefixConn(c net.Conn, prefix []byte) net.Conn {
+	if len(prefix) == 0 {
+		return c
+	}
+	return &prefixConn{Conn: c, prefix: prefix}
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the connection the replayed bytes were read from.
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
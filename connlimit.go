@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	maxConnections = flag.Int("max-connections", 0, "on the exit, most WebSocket connections open at once; more are refused with 503 and /readyz reports not ready while all are in use (0 = unlimited)")
+	maxConnsPerIP  = flag.Int("max-conns-per-ip", 0, "on the exit, most WebSocket connections open at once from one source IP, as resolved with -trusted-proxies; more are refused with 429 (0 = unlimited)")
+)
+
+///////////////////////
+//  出口机：连接数上限（总数 / 每个来源 IP）
+///////////////////////
+
+// exitConns counts the connections holding a -max-connections slot.
+var exitConns atomic.Int64
+
+// acquireConnSlot takes one of the -max-connections slots. It reports false
+// if all are in use; otherwise the caller calls release once the connection
+// ends.
+func acquireConnSlot() (release func(), ok bool) {
+	if *maxConnections <= 0 {
+		return func() {}, true
+	}
+	if exitConns.Add(1) > int64(*maxConnections) {
+		exitConns.Add(-1)
+		return nil, false
+	}
+	return func() { exitConns.Add(-1) }, true
+}
+
+// connSlotsFull reports whether every -max-connections slot is in use.
+func connSlotsFull() bool {
+	return *maxConnections > 0 && exitConns.Load() >= int64(*maxConnections)
+}
+
+// perIPConns counts the open connections from each source IP while
+// -max-conns-per-ip is on. An IP is dropped from the map when its count
+// goes back to zero.
+var perIPConns = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// sourceIP is the IP part of a clientAddr result, which has a port when it
+// is r.RemoteAddr and none when it came from a forwarding header, so both
+// forms of one client count together.
+func sourceIP(client string) string {
+	host := client
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		host = h
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().WithZone("").String()
+	}
+	return host
+}
+
+// acquireIPSlot counts one more connection from client. It reports false,
+// counting nothing, if that IP already has -max-conns-per-ip open; otherwise
+// the caller calls release once the connection ends.
+func acquireIPSlot(client string) (release func(), ok bool) {
+	if *maxConnsPerIP <= 0 {
+		return func() {}, true
+	}
+	ip := sourceIP(client)
+	perIPConns.Lock()
+	defer perIPConns.Unlock()
+	if perIPConns.m[ip] >= *maxConnsPerIP {
+		return nil, false
+	}
+	perIPConns.m[ip]++
+	return func() {
+		perIPConns.Lock()
+		defer perIPConns.Unlock()
+		if perIPConns.m[ip]--; perIPConns.m[ip] <= 0 {
+			delete(perIPConns.m, ip)
+		}
+	}, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMaxConnsPerIPCountsResolvedClient(t *testing.T) {
+	setFlag(t, maxConnsPerIP, 1)
+	setFlag(t, trustedProxies, "127.0.0.1")
+	loadTrustedProxies()
+	t.Cleanup(func() { trustedNets = nil })
+	url, _ := startPipeExit(t)
+
+	dial := func(forwardedFor string) (*websocket.Conn, int) {
+		ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {forwardedFor}})
+		if err != nil {
+			if resp == nil {
+				t.Fatal("dial:", err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws, http.StatusSwitchingProtocols
+	}
+
+	if _, status := dial("203.0.113.7"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("first connection from 203.0.113.7 got %d", status)
+	}
+	// All of these come from 127.0.0.1; only the resolved address counts.
+	if _, status := dial("198.51.100.9"); status != http.StatusSwitchingProtocols {
+		t.Errorf("connection from 198.51.100.9 got %d, want it let through", status)
+	}
+	if _, status := dial("192.0.2.66, 203.0.113.7"); status != http.StatusTooManyRequests {
+		t.Errorf("second connection from 203.0.113.7 got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestSourceIP(t *testing.T) {
+	for in, want := range map[string]string{
+		"203.0.113.7:51234":          "203.0.113.7",
+		"203.0.113.7":                "203.0.113.7",
+		"[2001:db8::7]:51234":        "2001:db8::7",
+		"[::ffff:203.0.113.7]:51234": "203.0.113.7",
+		"2001:db8::7":                "2001:db8::7",
+	} {
+		if got := sourceIP(in); got != want {
+			t.Errorf("sourceIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMaxConnectionsFlipsReadiness(t *testing.T) {
+	setFlag(t, mode, "exit")
+	setFlag(t, maxConnections, 1)
+	url, _ := startPipeExit(t)
+
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("/readyz %d before any connection", code)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz %d with every slot in use, want %d", code, http.StatusServiceUnavailable)
+	}
+	if reason := notReadyReason(); reason != "at -max-connections" {
+		t.Errorf("not ready because %q", reason)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection over -max-connections: %v, want a 503", err)
+	}
+
+	ws.Close()
+	waitFor(t, "a slot to free up", func() bool { return readyz() == http.StatusOK })
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var abortDialOnClose = flag.Bool("abort-dial-on-close", true, "on the entry, watch the player's connection while the WebSocket is being dialed and give the dial up if the player disconnects first, as port scanners do")
+
+///////////////////////
+//  入口机：玩家提前断开时放弃拨号
+///////////////////////
+
+// abortedDials counts backend dials given up because the player left first.
+var abortedDials atomic.Uint64
+
+// playerWatch waits for the first byte from a player connection while the
+// backend is dialed. A player that closes (or resets) the connection before
+// sending anything calls gone, which cancels the dial; one that sends a
+// byte is alive and no longer watched, and the byte is handed back by stop.
+// With -preconnect-buffer its reader does this job instead.
+type playerWatch struct {
+	conn net.Conn
+	buf  [1]byte
+	n    int
+	done chan struct{}
+}
+
+func startPlayerWatch(c net.Conn, gone func()) *playerWatch {
+	w := &playerWatch{conn: c, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		var err error
+		w.n, err = c.Read(w.buf[:])
+		if w.n == 0 && playerLeft(err) {
+			gone()
+		}
+	}()
+	return w
+}
+
+// stop interrupts the read and returns what it got, for newPrefixConn.
+func (w *playerWatch) stop() []byte {
+	_ = w.conn.SetReadDeadline(time.Now())
+	<-w.done
+	_ = w.conn.SetReadDeadline(time.Time{})
+	return w.buf[:w.n]
+}
+
+// playerLeft tells an error from the player's side apart from the read
+// deadline that stop sets.
+func playerLeft(err error) bool {
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var dialProxy = flag.String("dial-proxy", "", "reach -ws through this proxy: http://[user:pass@]host:port (HTTP CONNECT) or socks5://[user:pass@]host:port")
+
+// dialProxyURL is the parsed -dial-proxy; nil dials -ws directly.
+var dialProxyURL *url.URL
+
+func loadDialProxy() error {
+	if *dialProxy == "" {
+		return nil
+	}
+	u, err := url.Parse(*dialProxy)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("-dial-proxy must look like http://host:port or socks5://host:port, got %q", *dialProxy)
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return fmt.Errorf("-dial-proxy: unsupported scheme %q (must be http or socks5)", u.Scheme)
+	}
+	if *entryWsSRV != "" {
+		// The SRV target replaces the address dialed, which would be the
+		// proxy's.
+		return errors.New("-dial-proxy cannot be combined with -ws-srv")
+	}
+	dialProxyURL = u
+	return nil
+}
+
+// dialProxyFunc is the websocket.Dialer Proxy for -dial-proxy. The
+// connection to the proxy itself is still made through dialFunc.
+func dialProxyFunc() func(*http.Request) (*url.URL, error) {
+	if dialProxyURL == nil {
+		return nil
+	}
+	return http.ProxyURL(dialProxyURL)
+}
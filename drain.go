@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var startupProbe = flag.Bool("startup-probe", false, "on the exit, dial -exit-target every second at startup and keep /readyz not ready until it answers once")
+
+// draining is toggled by SIGUSR1 (see watchDrainSignal). While set, the
+// entry closes new player connections and the exit refuses new upgrades;
+// running bridges are left alone.
+var draining atomic.Bool
+
+func toggleDraining() {
+	if draining.CompareAndSwap(false, true) {
+		log.Println("Draining: refusing new connections, existing ones keep running")
+		return
+	}
+	draining.Store(false)
+	log.Println("Draining stopped: accepting new connections")
+}
+
+// handleHealthz is the liveness probe: it answers 200 as long as the
+// process can serve HTTP at all, draining or not. Load balancers should
+// use /readyz.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	connRegistry.Lock()
+	n := len(connRegistry.conns)
+	connRegistry.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Draining    bool `json:"draining"`
+		Connections int  `json:"connections"`
+	}{draining.Load(), n})
+}
+
+// targetReached is set by the exit's first successful target dial, from
+// the startup probe or a player.
+var targetReached atomic.Bool
+
+// notReadyReason says why new connections should go elsewhere, or "" when
+// this process is ready for them.
+func notReadyReason() string {
+	switch {
+	case draining.Load():
+		return "draining"
+	case *mode == "exit" && probingTarget() && !targetReached.Load():
+		return "target not reached yet"
+	case *mode == "exit" && connSlotsFull():
+		return "at -max-connections"
+	case *mode == "entry" && !anyBackendHealthy():
+		return "no healthy backend"
+	}
+	return ""
+}
+
+// handleReadyz is the readiness probe: 503 while draining, on the exit
+// with -startup-probe until the target has been reached once and while
+// every -max-connections slot is in use, and on the entry while every
+// backend's breaker is open.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	reason := notReadyReason()
+	w.Header().Set("Content-Type", "application/json")
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Ready  bool   `json:"ready"`
+		Reason string `json:"reason,omitempty"`
+	}{reason == "", reason})
+}
+
+// probingTarget reports whether readiness waits for the startup probe. A
+// -dynamic-target exit has no single target to probe.
+func probingTarget() bool {
+	return *startupProbe && *dynamicTarget == ""
+}
+
+// runStartupProbe dials -exit-target until the first success. Players
+// reaching the target first end it early.
+func runStartupProbe() {
+	for !targetReached.Load() {
+		c, err := dialTarget(*exitTargetAddr)
+		if err == nil {
+			_ = c.Close()
+			log.Println("[EXIT] Startup probe reached TCP target", *exitTargetAddr)
+			return
+		}
+		if *debug {
+			log.Println("[EXIT] Startup probe", dialErrKind(err)+":", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,4 @@
+package main
+
+// watchDrainSignal is a no-op: Windows has no SIGUSR1.
+func watchDrainSignal() {}
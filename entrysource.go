@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+var (
+	expectedEntryCIDRs  = flag.String("expected-entry-cidrs", "", "on the exit, comma-separated CIDRs or IPs the entry machines connect from (after -trusted-proxies); upgrades from elsewhere are logged")
+	expectedEntryStrict = flag.Bool("expected-entry-strict", false, "refuse upgrades from outside -expected-entry-cidrs instead of only logging them")
+)
+
+///////////////////////
+//  出口机：校验入口机来源
+///////////////////////
+
+// expectedEntryNets is the parsed -expected-entry-cidrs; empty means any
+// source is fine.
+var expectedEntryNets []netip.Prefix
+
+func loadExpectedEntries() error {
+	var err error
+	if expectedEntryNets, err = parsePrefixes("-expected-entry-cidrs", *expectedEntryCIDRs); err != nil {
+		return err
+	}
+	if *expectedEntryStrict && len(expectedEntryNets) == 0 {
+		return fmt.Errorf("-expected-entry-strict needs -expected-entry-cidrs")
+	}
+	return nil
+}
+
+// checkEntrySource reports whether the upgrade may go on. An upgrade from
+// outside -expected-entry-cidrs is logged, with the instance ID the
+// dialing proxy sent (if it is one of ours) to tell entries apart, and
+// with -expected-entry-strict refused. The loop check has run already, so
+// a request that carries this exit's own ID never gets here.
+func checkEntrySource(w http.ResponseWriter, r *http.Request, client string) bool {
+	if len(expectedEntryNets) == 0 {
+		return true
+	}
+	host := client
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		host = h
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && prefixesContain(expectedEntryNets, ip) {
+		return true
+	}
+
+	instance := r.Header.Get(instanceHeader)
+	if instance == "" {
+		instance = "none"
+	}
+	if !*expectedEntryStrict {
+		log.Println("[EXIT] WARNING: upgrade from", client, "(instance", instance+") is outside -expected-entry-cidrs")
+		return true
+	}
+	reject(rejectEntrySource, "[EXIT]", "upgrade from", client, "(instance", instance+") is outside -expected-entry-cidrs")
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is prepended to a flag's name to get its environment variable:
+// -exit-target is MCWS_EXIT_TARGET.
+const envPrefix = "MCWS_"
+
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvFlags fills every flag not given on the command line from its
+// MCWS_* variable, so the precedence is flag > environment > default.
+// Call it right after flag.Parse.
+func applyEnvFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		key := flagEnvName(f.Name)
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return
+		}
+		if e := flag.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s=%q: %w", key, v, e)
+		}
+	})
+	return err
+}
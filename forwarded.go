@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var trustedProxies = flag.String("trusted-proxies", "", "on the exit, comma-separated CIDRs or IPs of reverse proxies in front of it; only upgrades from these have their X-Forwarded-For / X-Real-IP honored")
+
+///////////////////////
+//  出口机：反向代理后的真实来源地址
+///////////////////////
+
+// trustedNets is the parsed -trusted-proxies; empty means headers are
+// never honored.
+var trustedNets []netip.Prefix
+
+func loadTrustedProxies() error {
+	var err error
+	trustedNets, err = parsePrefixes("-trusted-proxies", *trustedProxies)
+	return err
+}
+
+func isTrustedProxy(ip netip.Addr) bool {
+	return prefixesContain(trustedNets, ip)
+}
+
+// parsePrefixes parses a comma-separated list of IPs and CIDRs; a bare IP
+// is a single-address prefix.
+func parsePrefixes(name, list string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, item := range splitList(list) {
+		if ip, err := netip.ParseAddr(item); err == nil {
+			ip = ip.Unmap()
+			nets = append(nets, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an IP or CIDR", name, item)
+		}
+		nets = append(nets, p.Masked())
+	}
+	return nets, nil
+}
+
+func prefixesContain(nets []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range nets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr is where an upgrade request really came from. r.RemoteAddr is
+// used as is unless it is a trusted proxy; then X-Forwarded-For is walked
+// from the right, skipping trusted hops, and the first untrusted address is
+// the client. An entry that does not parse ends the walk at the hop that
+// appended it, since nothing left of it can be trusted. Without
+// X-Forwarded-For, X-Real-IP is used.
+func clientAddr(r *http.Request) string {
+	if len(trustedNets) == 0 {
+		return r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	hop, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(hop) {
+		return r.RemoteAddr
+	}
+
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, item := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(item))
+		}
+	}
+	if len(chain) == 0 {
+		if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return ip.Unmap().String()
+		}
+		return r.RemoteAddr
+	}
+	client := ""
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(chain[i])
+		if err != nil {
+			break
+		}
+		client = ip.Unmap().String()
+		if !isTrustedProxy(ip) {
+			return client
+		}
+	}
+	if client == "" {
+		return r.RemoteAddr
+	}
+	// Every hop is trusted (or the chain broke): the leftmost good one is
+	// as close to the client as we can tell.
+	return client
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var (
+	geoipDB          = flag.String("geoip-db", "", "on the entry, MaxMind GeoIP2/GeoLite2 Country (or City) .mmdb file used by -blocked-countries/-allowed-countries; reloaded on SIGHUP")
+	blockedCountries = flag.String("blocked-countries", "", "comma-separated ISO country codes (e.g. CN,RU) whose players are refused; needs -geoip-db")
+	allowedCountries = flag.String("allowed-countries", "", "comma-separated ISO country codes; only players from these countries may connect; needs -geoip-db")
+	geoipRejectText  = flag.String("geoip-reject-message", "You cannot join this server from your region", "disconnect message shown to players refused by country (only with -parse-handshake)")
+)
+
+///////////////////////
+//  入口机：按国家/地区拦截玩家
+///////////////////////
+
+var (
+	geoReader              atomic.Pointer[geoip2.Reader]
+	geoBlocked, geoAllowed map[string]bool // nil when not configured
+)
+
+func geoFilterEnabled() bool {
+	return geoBlocked != nil || geoAllowed != nil
+}
+
+// loadGeoIP opens -geoip-db and parses the country lists at startup. The
+// database is read into memory rather than mapped, so a reload can drop the
+// old one while lookups on it are still running.
+func loadGeoIP() error {
+	geoBlocked = countrySet(*blockedCountries)
+	geoAllowed = countrySet(*allowedCountries)
+	if *geoipDB == "" {
+		if geoFilterEnabled() {
+			return fmt.Errorf("-blocked-countries and -allowed-countries need -geoip-db")
+		}
+		return nil
+	}
+	if geoBlocked != nil && geoAllowed != nil {
+		return fmt.Errorf("use either -blocked-countries or -allowed-countries, not both")
+	}
+	if !geoFilterEnabled() {
+		log.Println("[ENTRY] -geoip-db is set but no -blocked-countries or -allowed-countries; not filtering")
+	}
+	if err := openGeoIP(); err != nil {
+		return err
+	}
+	watchGeoIPReload()
+	return nil
+}
+
+func openGeoIP() error {
+	data, err := os.ReadFile(*geoipDB)
+	if err != nil {
+		return err
+	}
+	r, err := geoip2.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *geoipDB, err)
+	}
+	geoReader.Store(r)
+	m := r.Metadata()
+	log.Printf("[ENTRY] Loaded GeoIP database %s (%s, built %s)", *geoipDB, m.DatabaseType, time.Unix(int64(m.BuildEpoch), 0).UTC().Format(time.DateOnly))
+	return nil
+}
+
+// watchGeoIPReload reopens -geoip-db on every SIGHUP. A database that fails
+// to load leaves the previous one in use.
+func watchGeoIPReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := openGeoIP(); err != nil {
+				log.Println("[ENTRY] Reload GeoIP database, keeping the old one:", err)
+			}
+		}
+	}()
+}
+
+func countrySet(list string) map[string]bool {
+	items := splitList(list)
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(items))
+	for _, c := range items {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+// playerCountry looks up the ISO code of ip's country, falling back to
+// the registered country for addresses the database has no location for.
+func playerCountry(ip net.IP) string {
+	r := geoReader.Load()
+	if r == nil {
+		return ""
+	}
+	rec, err := r.Country(ip)
+	if err != nil {
+		return ""
+	}
+	if rec.Country.IsoCode != "" {
+		return rec.Country.IsoCode
+	}
+	return rec.RegisteredCountry.IsoCode
+}
+
+// countryRefused reports whether a player from addr is turned away by the
+// country lists, and the country it was looked up as. Loopback and private
+// addresses are never refused. With -allowed-countries, a public address
+// the database does not know is refused.
+func countryRefused(addr net.Addr) (string, bool) {
+	if !geoFilterEnabled() {
+		return "", false
+	}
+	ip := addrIP(addr)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return "", false
+	}
+	country := playerCountry(ip)
+	if geoAllowed != nil {
+		return country, !geoAllowed[country]
+	}
+	return country, geoBlocked[country]
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// refuseCountry closes a player refused by country. With handshake parsing
+// on, a login attempt is shown -geoip-reject-message first.
+func refuseCountry(conn net.Conn, country string) {
+	if country == "" {
+		country = "unknown"
+	}
+	reject(rejectCountry, "[ENTRY]", "refused player from", conn.RemoteAddr(), "in country", country)
+	if !handshakeEnabled() {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(handshakeReadTimeout))
+	hello, _, _ := readClientHello(conn)
+	if hello != nil && (hello.NextState == mcStateLogin || hello.NextState == mcStateTransfer) {
+		_ = writeLoginDisconnect(conn, *geoipRejectText)
+	}
+}
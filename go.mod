@@ -2,6 +2,13 @@ module mc-ws-proxy
 
 go 1.21
 
-require github.com/gorilla/websocket v1.5.1
+require (
+	github.com/gorilla/websocket v1.5.1
+	github.com/oschwald/geoip2-golang v1.11.0
+	golang.org/x/sys v0.20.0
+)
 
-require golang.org/x/net v0.17.0 // indirect
+require (
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+)
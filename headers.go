@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// headerFlag collects repeated -ws-header "Key: Value" options.
+type headerFlag struct {
+	header http.Header
+}
+
+func (f *headerFlag) String() string {
+	if f == nil || f.header == nil {
+		return ""
+	}
+	var parts []string
+	for k, vs := range f.header {
+		for _, v := range vs {
+			parts = append(parts, k+": "+v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f *headerFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("want \"Key: Value\", got %q", v)
+	}
+	if f.header == nil {
+		f.header = http.Header{}
+	}
+	f.header.Add(textproto.CanonicalMIMEHeaderKey(key), strings.TrimSpace(value))
+	return nil
+}
+
+var wsHeaders headerFlag
+
+var wsHost = flag.String("ws-host", "", "Host header for the WebSocket upgrade request, default the -ws host; TLS SNI and the dialed address still come from -ws (and -ws-sni)")
+
+func init() {
+	flag.Var(&wsHeaders, "ws-header", "extra header for the WebSocket upgrade request, \"Key: Value\" (repeatable)")
+}
+
+// checkWSHost rejects -ws-host values that are not a bare host[:port].
+// Anything else would produce a malformed upgrade request.
+func checkWSHost() error {
+	if *wsHost == "" {
+		return nil
+	}
+	u, err := url.Parse("//" + *wsHost)
+	if err != nil || u.Host != *wsHost || u.Hostname() == "" {
+		return fmt.Errorf("-ws-host must be host or host:port, got %q", *wsHost)
+	}
+	return nil
+}
+
+// backendHeader builds the extra request headers sent when dialing -ws.
+func backendHeader() http.Header {
+	h := wsHeaders.header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	if *wsHost != "" {
+		// gorilla/websocket sends this as the request's Host.
+		h.Set("Host", *wsHost)
+	}
+	if *wsBasicUser != "" || *wsBasicPass != "" {
+		req := http.Request{Header: h}
+		req.SetBasicAuth(*wsBasicUser, *wsBasicPass)
+	}
+	if *authToken != "" {
+		h.Set(authTokenHeader, *authToken)
+	}
+	h.Set(instanceHeader, instanceID)
+	return h
+}
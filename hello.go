@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
+)
+
+var (
+	proxyHello      = flag.Bool("proxy-hello", false, "entry: send a proxy hello frame with the player's address first; exit: require it (both ends must enable it)")
+	proxyHelloToken = flag.String("proxy-hello-token", "", "shared token carried in the proxy hello; the exit closes connections whose token differs")
+)
+
+// The proxy hello is the first binary message on the WebSocket when
+// -proxy-hello is on. All integers are big-endian:
+//
+//	magic    4 bytes  "MCWH"
+//	version  1 byte   1
+//	ip len   1 byte   0 (unknown, e.g. unix socket), 4 or 16
+//	ip       ip len bytes
+//	port     2 bytes
+//	tok len  1 byte
+//	token    tok len bytes
+//
+// Nothing may follow the token. The exit closes the connection (1008) on
+// any mismatch instead of guessing.
+const (
+	proxyHelloMagic   = "MCWH"
+	proxyHelloVersion = 1
+)
+
+var errProxyHello = errors.New("bad proxy hello")
+
+// encodeProxyHello builds the hello for a player connecting from addr.
+func encodeProxyHello(addr net.Addr, token string) []byte {
+	b := append([]byte(proxyHelloMagic), proxyHelloVersion)
+	var ap netip.AddrPort
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ap = ta.AddrPort()
+	}
+	ip := ap.Addr().Unmap()
+	switch {
+	case ip.Is4():
+		v := ip.As4()
+		b = append(b, 4)
+		b = append(b, v[:]...)
+	case ip.Is6():
+		v := ip.As16()
+		b = append(b, 16)
+		b = append(b, v[:]...)
+	default:
+		b = append(b, 0)
+	}
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+	b = append(b, byte(len(token)))
+	return append(b, token...)
+}
+
+// decodeProxyHello parses a hello and returns the player's address, or ""
+// when the entry did not know it.
+func decodeProxyHello(b []byte) (addr, token string, err error) {
+	if !bytes.HasPrefix(b, []byte(proxyHelloMagic)) {
+		return "", "", fmt.Errorf("%w: wrong magic", errProxyHello)
+	}
+	b = b[len(proxyHelloMagic):]
+	if len(b) < 2 || b[0] != proxyHelloVersion {
+		return "", "", fmt.Errorf("%w: unsupported version", errProxyHello)
+	}
+	ipLen := int(b[1])
+	b = b[2:]
+	if (ipLen != 0 && ipLen != 4 && ipLen != 16) || len(b) < ipLen+3 {
+		return "", "", fmt.Errorf("%w: bad address", errProxyHello)
+	}
+	ip, _ := netip.AddrFromSlice(b[:ipLen])
+	port := binary.BigEndian.Uint16(b[ipLen:])
+	b = b[ipLen+2:]
+	if len(b) != 1+int(b[0]) {
+		return "", "", fmt.Errorf("%w: bad token length", errProxyHello)
+	}
+	if ipLen > 0 {
+		addr = netip.AddrPortFrom(ip, port).String()
+	}
+	return addr, string(b[1:]), nil
+}
+
+// sendProxyHello writes the hello for player as the first message on ws.
+func sendProxyHello(ws *websocket.Conn, player net.Addr) error {
+	_ = ws.SetWriteDeadline(time.Now().Add(proxy.TCPWriteTimeout))
+	return ws.WriteMessage(websocket.BinaryMessage, encodeProxyHello(player, *proxyHelloToken))
+}
+
+// readProxyHello reads and checks the hello on the exit. On failure it has
+// already sent a policy violation close frame.
+func readProxyHello(ws *websocket.Conn) (string, error) {
+	_ = ws.SetReadDeadline(time.Now().Add(handshakeReadTimeout))
+	msgType, data, err := ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	addr, token, err := "", "", fmt.Errorf("%w: not a binary message", errProxyHello)
+	if msgType == websocket.BinaryMessage {
+		addr, token, err = decodeProxyHello(data)
+	}
+	if err == nil && subtle.ConstantTimeCompare([]byte(token), []byte(*proxyHelloToken)) != 1 {
+		err = fmt.Errorf("%w: wrong token", errProxyHello)
+	}
+	if err != nil {
+		_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "bad proxy hello"), time.Now().Add(proxy.CloseWait))
+		return "", err
+	}
+	return addr, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	listenTLSCert = flag.String("listen-tls-cert", "", "on the entry, PEM certificate (chain) for accepting players over TLS on -listen, for client mods that speak Minecraft over TLS (needs -listen-tls-key)")
+	listenTLSKey  = flag.String("listen-tls-key", "", "PEM private key for -listen-tls-cert")
+)
+
+///////////////////////
+//  入口机：玩家侧 TLS
+///////////////////////
+
+// listenTLSConfig is nil unless -listen-tls-cert is set.
+var listenTLSConfig *tls.Config
+
+func loadListenTLS() error {
+	switch {
+	case *listenTLSCert == "" && *listenTLSKey == "":
+		return nil
+	case *listenTLSCert == "" || *listenTLSKey == "":
+		return fmt.Errorf("-listen-tls-cert and -listen-tls-key go together")
+	case *mode != "entry":
+		return fmt.Errorf("-listen-tls-cert is for the entry")
+	}
+	cert, err := tls.LoadX509KeyPair(*listenTLSCert, *listenTLSKey)
+	if err != nil {
+		return fmt.Errorf("-listen-tls-cert: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.MinVersion, err = parseTLSVersion(*tlsMinVersion); err != nil {
+		return err
+	}
+	if cfg.CipherSuites, err = parseCipherSuites(*tlsCipherSuites); err != nil {
+		return err
+	}
+	listenTLSConfig = cfg
+	return nil
+}
+
+// acceptTLS runs the server handshake on a player connection. It comes
+// after the PROXY header, which a load balancer sends in the clear, so
+// RemoteAddr and LocalAddr still report what the earlier steps found.
+func acceptTLS(c net.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeReadTimeout)
+	defer cancel()
+	tc := tls.Server(c, listenTLSConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	_ = c.SetDeadline(time.Time{})
+	return tc, nil
+}
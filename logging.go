@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	quiet          = flag.Bool("quiet", false, "do not log the routine per-connection lines (new player, connected, closed); warnings and errors are still logged")
+	logDedupWindow = flag.Duration("log-dedup-window", 10*time.Second, "log a line repeated within this window once, followed by a count when the window ends (0 = log every line; off with -debug)")
+	instanceLabel  = flag.String("instance-label", "", "name for this proxy, e.g. its region; added to every /metrics series as instance_label and, when set, after the timestamp of every log line (default: the hostname, for metrics only)")
+)
+
+///////////////////////
+//  日志：安静模式和重复行合并
+///////////////////////
+
+// logInfo logs a routine line that -quiet suppresses.
+func logInfo(v ...any) {
+	if !*quiet {
+		log.Println(v...)
+	}
+}
+
+// logTimeLen is the length of the date and time log.LstdFlags puts in
+// front of each line.
+const logTimeLen = len("2006/01/02 15:04:05 ")
+
+// dedupMaxKeys bounds the lines remembered per window; past it, new lines
+// are logged as they come.
+const dedupMaxKeys = 1024
+
+// metricsInstance is the instance_label value on /metrics: -instance-label,
+// or the hostname when it is unset.
+var metricsInstance string
+
+func setupLogging() {
+	metricsInstance = *instanceLabel
+	if metricsInstance == "" {
+		metricsInstance, _ = os.Hostname()
+	} else {
+		log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+		log.SetPrefix("[" + *instanceLabel + "] ")
+	}
+	if *logDedupWindow > 0 && !*debug {
+		w := &dedupWriter{out: os.Stderr, window: *logDedupWindow, seen: make(map[string]*dedupEntry)}
+		log.SetOutput(w)
+		go w.sweep()
+	}
+}
+
+// dedupWriter sits under the standard logger. The first time a message
+// (the line without its timestamp) is seen it goes out right away; repeats
+// within the window are only counted, and once the window ends a single
+// "repeated N times" line reports them. Multi-line entries such as hex
+// dumps are never merged.
+type dedupWriter struct {
+	out    io.Writer
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	first time.Time
+	count int // repeats suppressed since first
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	if len(p) <= logTimeLen || bytes.IndexByte(p[:len(p)-1], '\n') >= 0 {
+		return w.out.Write(p)
+	}
+	msg := string(p[logTimeLen:])
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e := w.seen[msg]; e != nil {
+		if now.Sub(e.first) < w.window {
+			e.count++
+			return len(p), nil
+		}
+		w.report(msg, e)
+		delete(w.seen, msg)
+	}
+	if len(w.seen) < dedupMaxKeys {
+		w.seen[msg] = &dedupEntry{first: now}
+	}
+	return w.out.Write(p)
+}
+
+// sweep reports and forgets the lines whose window has ended.
+func (w *dedupWriter) sweep() {
+	for range time.Tick(w.window / 4) {
+		now := time.Now()
+		w.mu.Lock()
+		for msg, e := range w.seen {
+			if now.Sub(e.first) >= w.window {
+				w.report(msg, e)
+				delete(w.seen, msg)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// report writes the summary for e, if anything was suppressed. w.mu is
+// held.
+func (w *dedupWriter) report(msg string, e *dedupEntry) {
+	if e.count == 0 {
+		return
+	}
+	line := make([]byte, 0, logTimeLen+len(msg)+40)
+	line = time.Now().AppendFormat(line, "2006/01/02 15:04:05 ")
+	line = append(line, msg[:len(msg)-1]...)
+	line = append(line, " (repeated "...)
+	line = strconv.AppendInt(line, int64(e.count), 10)
+	line = append(line, " times in "...)
+	line = append(line, w.window.String()...)
+	line = append(line, ")\n"...)
+	_, _ = w.out.Write(line)
+}
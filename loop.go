@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// instanceHeader carries the dialing proxy's instanceID on every upgrade
+// request, so an exit can tell when a request came from itself.
+const instanceHeader = "X-Mcws-Instance"
+
+// instanceID identifies this process. It is generated once at startup.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isLoopRequest reports whether an upgrade request carries our own
+// instance ID, i.e. the request went out of this process and came back in.
+func isLoopRequest(r *http.Request) bool {
+	return r.Header.Get(instanceHeader) == instanceID
+}
+
+// refuseLoop answers an upgrade request that came from this process.
+func refuseLoop(w http.ResponseWriter, r *http.Request) {
+	reject(rejectLoop, "[EXIT]", "LOOP DETECTED: upgrade request from", clientAddr(r), "carries our own instance ID; check that -ws does not point back at this proxy")
+	http.Error(w, "loop detected", http.StatusLoopDetected)
+}
+
+// pendingDials holds the local address of each WebSocket connection the
+// entry is still handshaking on. A player connection arriving from one of
+// these addresses is the entry talking to itself: -ws points at -listen.
+var pendingDials sync.Map // string -> struct{}
+
+// trackDial wraps dial so that the connection's local address is listed in
+// pendingDials until the caller calls the returned done func.
+func trackDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) (func(ctx context.Context, network, addr string) (net.Conn, error), func()) {
+	var mu sync.Mutex
+	var keys []string
+	wrapped := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err == nil {
+			key := c.LocalAddr().String()
+			pendingDials.Store(key, struct{}{})
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+		}
+		return c, err
+	}
+	done := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, k := range keys {
+			pendingDials.Delete(k)
+		}
+	}
+	return wrapped, done
+}
+
+// isSelfDial reports whether c is the far end of one of our own pending
+// WebSocket dials.
+func isSelfDial(c net.Conn) bool {
+	_, ok := pendingDials.Load(c.RemoteAddr().String())
+	return ok
+}
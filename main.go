@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,28 +11,78 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
 )
 
 var (
-	mode             = flag.String("mode", "entry", "mode: entry | exit")
-	debug            = flag.Bool("debug", false, "enable debug logging like wsmc")
-	dumpBytes        = flag.Bool("dump-bytes", false, "dump hex for each proxied frame (implies -debug)")
-	maxFramePayload  = flag.Int64("max-frame-payload", 65536, "maximum WebSocket payload length (similar to wsmc.maxFramePayloadLength)")
-	pingInterval     = flag.Duration("ping-interval", 25*time.Second, "WebSocket ping interval to keep connections alive through CDN")
+	mode               = flag.String("mode", "entry", "mode: entry | exit")
+	debug              = flag.Bool("debug", false, "enable debug logging like wsmc")
+	dumpBytes          = flag.Bool("dump-bytes", false, "dump hex for each proxied frame (implies -debug)")
+	dumpWidth          = flag.Int("dump-width", proxy.DefaultDumpWidth, "bytes per line in -dump-bytes output")
+	maxFramePayload    = flag.Int64("max-frame-payload", 65536, "maximum WebSocket payload length (similar to wsmc.maxFramePayloadLength)")
+	maxTCPWrite        = flag.Int("max-tcp-write", 0, "close the bridge (code 1009) when a binary frame larger than this is to be written to TCP (0 = only -max-frame-payload applies)")
+	readBufferSize     = flag.Int("read-buffer-size", 8192, "TCP read buffer size; reads larger than -max-frame-payload are split into several frames")
+	writeQueueSize     = flag.Int("write-queue-size", 0, "frames buffered between the TCP reader and the WebSocket writer; pings then no longer wait behind queued frames (0 = write synchronously)")
+	maxTotalReassembly = flag.Int64("max-total-reassembly", 0, "bytes of WebSocket messages all connections together may hold while reading them whole; above it, a message larger than -read-buffer-size closes its connection with 1009 (0 = unlimited, still shown in /metrics)")
+	maxConnMemory      = flag.Int64("max-conn-memory", 0, "bytes one connection may hold in buffers (read buffers, -write-queue-size frames, WebSocket messages not yet written to TCP); reads wait when it is reached, and a message too big to fit closes the connection with 1009 (0 = unlimited)")
+	coalesceDelay      = flag.Duration("coalesce-delay", 0, "wait up to this long (e.g. 5ms) to merge small TCP reads into one WebSocket frame (0 = disabled)")
+	tcpReadTimeout     = flag.Duration("tcp-read-timeout", 120*time.Second, "close the bridge when the TCP side sends nothing for this long (0 = no deadline, rely on TCP keepalive and WS pings)")
+	tcpWriteIdle       = flag.Bool("tcp-write-resets-idle", false, "let data successfully written to the TCP side restart -tcp-read-timeout too, for a target that is busy receiving but quiet for long stretches")
+	wsReadTimeout      = flag.Duration("ws-read-timeout", 60*time.Second, "close the bridge when nothing, not even a pong, arrives on the WebSocket for this long (0 = no deadline)")
+	pingInterval       = flag.Duration("ping-interval", 25*time.Second, "WebSocket ping interval to keep connections alive through CDN")
+	pingJitter         = flag.Float64("ping-jitter", 0, "randomize each ping interval by up to this fraction of -ping-interval, e.g. 0.2 for ±20%, so many connections do not ping in sync (0 = fixed interval)")
+	handshakeTimeout   = flag.Duration("handshake-timeout", 0, "close connections whose peer sends nothing this long after the bridge starts: the player's first byte on the entry, the first binary frame from the entry on the exit (0 = disabled)")
+	closeTimeout       = flag.Duration("close-timeout", proxy.CloseWait, "how long tearing down a WebSocket may wait for the close frame to be written")
+	skipCloseHandshake = flag.Bool("skip-close-handshake", false, "close WebSocket connections without sending a close frame (for CDNs that mangle them)")
+	maxConnLifetime    = flag.Duration("max-conn-lifetime", 0, "close each bridge after this long to force clients to reconnect (0 = disabled)")
+	reusePort          = flag.Bool("reuseport", false, "set SO_REUSEPORT on the TCP listener so several processes can share the port and the kernel spreads new connections among them (Linux/BSD/macOS; ignored elsewhere)")
+	listenBacklog      = flag.Int("listen-backlog", 0, "accept queue length for -listen and -exit-listen, capped by the kernel at somaxconn (0 = system default, somaxconn on Linux; Unix-like systems only)")
+	listenNetwork      = flag.String("listen-network", "tcp", "network for the TCP listener: tcp (dual-stack) | tcp4 | tcp6")
+	dialNetwork        = flag.String("dial-network", "tcp", "address family for outgoing connections, both the entry's -ws dial and the exit's -exit-target dial: tcp (either) | tcp4 | tcp6")
+	wsReadBuffer       = flag.Int("ws-read-buffer", 0, "WebSocket read buffer size in bytes on both ends (0 = library default, 4096)")
+	wsWriteBuffer      = flag.Int("ws-write-buffer", 0, "WebSocket write buffer size in bytes on both ends (0 = library default, 4096)")
+	onTextFrame        = flag.String("on-text-frame", "ignore", "what to do with incoming WebSocket text frames: ignore | log | error (close the bridge, code 1003) | forward (write them to TCP)")
+	maxFPS             = flag.Int("max-fps", 0, "cap on the frames per second each connection may forward in each direction, counted per TCP read and per WebSocket message (0 = unlimited)")
+	fpsAction          = flag.String("fps-action", "throttle", "what to do with a connection over -max-fps: throttle (slow its reads down) or close (close it with 1008)")
+	globalRateLimit    = flag.Int64("global-rate-limit", 0, "cap on the bytes per second forwarded by all connections together, both directions counted (0 = unlimited)")
+	strictFrames       = flag.Bool("strict-frames", false, "close the WebSocket with 1002 (protocol error) on any frame type the proxy does not handle instead of ignoring it; with -on-text-frame error, text frames too")
+	streamFrames       = flag.Bool("stream-frames", false, "copy each incoming WebSocket binary message to TCP while it is still arriving instead of reading it whole first, so large messages do not sit in memory (lifts -max-frame-payload for incoming binary messages)")
+	corkWrites         = flag.Bool("cork-writes", false, "when several WebSocket frames arrive back to back, hold their TCP writes with TCP_CORK and send them as fewer segments (Linux only, ignored elsewhere)")
+	tcpNoDelay         = flag.Bool("tcp-nodelay", true, "disable Nagle's algorithm on player and target TCP connections; false lets the kernel coalesce small writes, better for bulk tunnels than for Minecraft")
+	halfClose          = flag.Bool("half-close", false, "on clean TCP EOF, half-close the tunnel and keep copying the other direction (both ends must enable it)")
 
 	// 入口机参数（玩家 <-> WebSocket）
-	entryListenAddr  = flag.String("listen", envOrDefault("ENTRY_LISTEN_ADDR", ":25565"), "TCP listen address for players, e.g. :25565")
-	entryWsServerURL = flag.String("ws", envOrDefault("ENTRY_WS_URL", "wss://mc.example.com/ws"), "WebSocket server URL (Cloudflare hostname), e.g. wss://mc.example.com/ws")
-	entrySkipTLS     = flag.Bool("skip-tls-verify", true, "skip TLS certificate verification when dialing entry WebSocket (insecure)")
+	entryListenAddr   = flag.String("listen", envOrDefault("ENTRY_LISTEN_ADDR", ":25565"), "TCP listen address for players, e.g. :25565 or unix:/run/mc-ws-proxy.sock")
+	acceptConcurrency = flag.Int("accept-concurrency", 0, "maximum concurrently handled player connections; accepting pauses when reached (0 = unlimited)")
+	entryWsServerURL  = flag.String("ws", envOrDefault("ENTRY_WS_URL", "wss://mc.example.com/ws"), "WebSocket server URL (Cloudflare hostname), e.g. wss://mc.example.com/ws; several comma-separated URLs are used round robin")
+	entryWsSRV        = flag.String("ws-srv", "", "resolve the -ws host via this SRV service, e.g. _mcws._tcp (falls back to the literal host)")
+	entryDialTimeout  = flag.Duration("ws-dial-timeout", 10*time.Second, "timeout for dialing the WebSocket backend, including the TLS and upgrade handshake")
+	firstWriteRetries = flag.Int("first-write-retries", 1, "redial the backend this many times when the first write fails before any data was forwarded (synchronous writes only)")
+	entrySkipTLS      = flag.Bool("skip-tls-verify", true, "skip TLS certificate verification when dialing entry WebSocket (insecure)")
+	entryCAFile       = flag.String("ca-file", "", "PEM file with CA certificates to trust for the WebSocket backend (needs -skip-tls-verify=false)")
+	entryWsSNI        = flag.String("ws-sni", "", "TLS server name (SNI and certificate check) for the WebSocket backend, default the -ws host")
+	logTLS            = flag.Bool("log-tls", false, "log the negotiated TLS version, cipher suite, ALPN and backend certificate of each WebSocket connection (also with -debug)")
+	tlsMinVersion     = flag.String("tls-min-version", "1.2", "minimum TLS version for the WebSocket backend and for players on -listen-tls-cert: 1.2 | 1.3")
+	tlsCipherSuites   = flag.String("tls-cipher-suites", "", "comma-separated TLS 1.2 cipher suites for the WebSocket backend and for players on -listen-tls-cert, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default Go's list; TLS 1.3 suites are not configurable)")
 
 	// 出口机参数（WebSocket <-> 本地MC）
-	exitListenAddr = flag.String("exit-listen", envOrDefault("EXIT_LISTEN_ADDR", ":8080"), "WebSocket listen address on exit server, e.g. :8080")
-	exitTargetAddr = flag.String("exit-target", envOrDefault("EXIT_TARGET_ADDR", "127.0.0.1:25565"), "TCP target address (Minecraft server), e.g. 127.0.0.1:25565")
+	exitListenAddr     = flag.String("exit-listen", envOrDefault("EXIT_LISTEN_ADDR", ":8080"), "WebSocket listen address on exit server, e.g. :8080 or unix:/run/mc-ws-proxy.sock")
+	exitTargetAddr     = flag.String("exit-target", envOrDefault("EXIT_TARGET_ADDR", "127.0.0.1:25565"), "TCP target address (Minecraft server), e.g. 127.0.0.1:25565 or unix:/run/minecraft.sock")
+	exitDialTimeout    = flag.Duration("target-dial-timeout", 10*time.Second, "timeout for dialing the TCP target")
+	exitAllowedOrigins = flag.String("allowed-origins", "", "comma-separated Origin patterns the exit accepts, * as wildcard (empty = any)")
+	maxHeaderBytes     = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "largest upgrade request header the exit reads, request line included; bigger ones get 431")
+	plainRequestStatus = flag.Int("plain-request-status", http.StatusOK, "status the exit answers a request to /ws without a WebSocket upgrade with, such as a load balancer health probe: 200 or 426 (Upgrade Required)")
+	readHeaderTimeout  = flag.Duration("read-header-timeout", 0, "time the exit allows a client to send the upgrade request headers, against slow-header attacks (0 = no limit)")
 )
 
 func envOrDefault(key, def string) string {
@@ -41,22 +92,338 @@ func envOrDefault(key, def string) string {
 	return def
 }
 
-const (
-	tcpReadTimeout  = 120 * time.Second
-	tcpWriteTimeout = 30 * time.Second
-	wsReadTimeout   = 60 * time.Second
-	closeWait       = 2 * time.Second
-)
+// splitNetAddr maps "unix:/path/to/sock" to the unix network and anything
+// else to tcp.
+func splitNetAddr(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// listen opens the listener for -listen or -exit-listen, using
+// -listen-network to pin TCP listeners to one address family. With
+// -systemd-socket the socket inherited from systemd takes precedence.
+func listen(addr string) (net.Listener, error) {
+	if *systemdSocket {
+		if ln, ok, err := systemdListener(); ok {
+			if err == nil {
+				log.Println("Using socket passed by systemd:", ln.Addr())
+			}
+			return ln, err
+		}
+	}
+	network, address := splitNetAddr(addr)
+	var ln net.Listener
+	var err error
+	if network == "unix" {
+		ln, err = listenUnix(address)
+	} else {
+		var lc net.ListenConfig
+		if *reusePort {
+			if reusePortSupported {
+				lc.Control = setReusePort
+			} else {
+				log.Println("-reuseport is not supported on this platform, ignoring it")
+			}
+		}
+		ln, err = listenFunc(context.Background(), &lc, *listenNetwork, address)
+	}
+	if err != nil || *listenBacklog == 0 {
+		return ln, err
+	}
+	if !listenBacklogSupported {
+		log.Println("-listen-backlog is not supported on this platform, ignoring it")
+		return ln, nil
+	}
+	if err := setListenBacklog(ln, *listenBacklog); err != nil {
+		_ = ln.Close()
+		return nil, fmt.Errorf("-listen-backlog: %w", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a Unix socket, first removing a stale socket file
+// left behind by a process that did not shut down cleanly. A socket that
+// still accepts connections belongs to a running process and is an error.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := dialFunc(context.Background(), new(net.Dialer), "unix", path); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		log.Println("Removed stale socket", path)
+	}
+	return listenFunc(context.Background(), new(net.ListenConfig), "unix", path)
+}
+
+// allowedOrigins is parsed from -allowed-origins.
+var allowedOrigins []string
 
+// wsWriteBufferPool lets idle connections hand their write buffer back
+// instead of each holding one for its whole life.
+var wsWriteBufferPool sync.Pool
+
+// upgrader's buffer sizes are set from the flags in main.
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// 如需限制来源（只允许 Cloudflare IP），可以在这里做检查
+	CheckOrigin:     checkOrigin,
+	WriteBufferPool: &wsWriteBufferPool,
+}
+
+// checkOrigin enforces -allowed-origins. Requests without an Origin header
+// (the entry, native clients) are not from a browser and always pass.
+func checkOrigin(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
 		return true
-	},
+	}
+	for _, pattern := range allowedOrigins {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(origin)) {
+			return true
+		}
+	}
+	log.Printf("[EXIT] Rejected origin %q from %s", origin, clientAddr(r))
+	return false
+}
+
+// matchWildcard matches s against a pattern where * stands for any run of
+// characters, e.g. https://*.example.com.
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// dialErrKind tells timeouts (target dropping SYNs, stuck handshakes)
+// apart from outright failures such as connection refused.
+func dialErrKind(err error) string {
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return "timeout"
+	}
+	return "error"
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
 }
 
 func main() {
 	flag.Parse()
+	if err := applyEnvFlags(); err != nil {
+		log.Fatal(err)
+	}
+	setupLogging()
+
+	if *maxFramePayload <= 0 {
+		log.Fatalf("-max-frame-payload must be positive, got %d", *maxFramePayload)
+	}
+	if *muxEnabled && *maxFramePayload <= muxFrameHeader {
+		log.Fatalf("-max-frame-payload must be larger than %d with -mux", muxFrameHeader)
+	}
+	if len(*proxyHelloToken) > 255 {
+		log.Fatal("-proxy-hello-token must be at most 255 bytes")
+	}
+	if *pingJitter < 0 || *pingJitter >= 1 {
+		log.Fatalf("-ping-jitter must be at least 0 and below 1, got %v", *pingJitter)
+	}
+	if *maxFPS < 0 {
+		log.Fatalf("-max-fps must not be negative, got %d", *maxFPS)
+	}
+	if *fpsAction != "throttle" && *fpsAction != "close" {
+		log.Fatalf("unknown -fps-action: %s (must be throttle or close)", *fpsAction)
+	}
+	if *globalRateLimit < 0 {
+		log.Fatalf("-global-rate-limit must not be negative, got %d", *globalRateLimit)
+	} else if *globalRateLimit > 0 {
+		globalLimiter = proxy.NewRateLimiter(*globalRateLimit)
+	}
+	if *maxTotalReassembly < 0 {
+		log.Fatalf("-max-total-reassembly must not be negative, got %d", *maxTotalReassembly)
+	}
+	globalReassembly = proxy.NewReassembly(*maxTotalReassembly)
+	if *closeTimeout <= 0 {
+		log.Fatalf("-close-timeout must be positive, got %v", *closeTimeout)
+	}
+	if *maxHeaderBytes <= 0 {
+		log.Fatalf("-max-header-bytes must be positive, got %d", *maxHeaderBytes)
+	}
+	if *readHeaderTimeout < 0 {
+		log.Fatalf("-read-header-timeout must not be negative, got %v", *readHeaderTimeout)
+	}
+	if *dumpWidth <= 0 {
+		log.Fatalf("-dump-width must be positive, got %d", *dumpWidth)
+	}
+	if *streamFrames && *corkWrites {
+		log.Fatal("-stream-frames and -cork-writes cannot be used together")
+	}
+	if *corkWrites && *targetReconnectWindow > 0 {
+		log.Println("-cork-writes has no effect with -target-reconnect-window, whose target connection can be replaced between writes")
+	}
+	if *maxTCPWrite < 0 {
+		log.Fatalf("-max-tcp-write must not be negative, got %d", *maxTCPWrite)
+	}
+	if *maxConnMemory != 0 {
+		sizes := proxy.Config{ReadBufferSize: *readBufferSize, MaxFramePayload: *maxFramePayload, StreamFrames: *streamFrames}
+		if min := proxy.MinConnMemory(&sizes); *maxConnMemory < min {
+			log.Fatalf("-max-conn-memory must be 0 or at least %d (the read buffers plus one frame each way), got %d", min, *maxConnMemory)
+		}
+	}
+	var err error
+	if textPolicy, err = parseTextPolicy(*onTextFrame); err != nil {
+		log.Fatal(err)
+	}
+	if *readBufferSize <= 0 {
+		log.Fatalf("-read-buffer-size must be positive, got %d", *readBufferSize)
+	}
+	if *writeTimeoutRetries < 0 {
+		log.Fatalf("-write-timeout-retries must not be negative, got %d", *writeTimeoutRetries)
+	}
+	if int64(*readBufferSize) > *maxFramePayload {
+		// Reads are split at -max-frame-payload, so this side never sends
+		// a frame over it; the disconnects come from a peer configured with
+		// a smaller limit than the one this side splits at.
+		log.Printf("WARNING: -read-buffer-size %d is larger than -max-frame-payload %d: each TCP read goes out as up to %d frames. The peer must use a -max-frame-payload of at least %d, or it will close the connection with 1009.",
+			*readBufferSize, *maxFramePayload, (int64(*readBufferSize)+*maxFramePayload-1) / *maxFramePayload, *maxFramePayload)
+	}
+	if *wsReadBuffer < 0 || *wsWriteBuffer < 0 {
+		log.Fatal("-ws-read-buffer and -ws-write-buffer must not be negative")
+	}
+	upgrader.ReadBufferSize = *wsReadBuffer
+	upgrader.WriteBufferSize = *wsWriteBuffer
+	if *wsReadTimeout > 0 && *targetReconnectWindow >= *wsReadTimeout {
+		// A writer held that long would let the WebSocket read deadline expire.
+		log.Fatalf("-target-reconnect-window must be shorter than -ws-read-timeout (%v)", *wsReadTimeout)
+	}
+	switch *listenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("unknown -listen-network: %s (must be tcp, tcp4 or tcp6)", *listenNetwork)
+	}
+	switch *dialNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("unknown -dial-network: %s (must be tcp, tcp4 or tcp6)", *dialNetwork)
+	}
+	if *listenBacklog < 0 {
+		log.Fatalf("-listen-backlog must not be negative, got %d", *listenBacklog)
+	}
+	if *plainRequestStatus != http.StatusOK && *plainRequestStatus != http.StatusUpgradeRequired {
+		log.Fatalf("-plain-request-status must be 200 or 426, got %d", *plainRequestStatus)
+	}
+	allowedOrigins = splitList(*exitAllowedOrigins)
+	if err := loadUsernameLists(); err != nil {
+		log.Fatal("load username list: ", err)
+	}
+	if *mode == "entry" {
+		if err := loadGeoIP(); err != nil {
+			log.Fatal("load GeoIP database: ", err)
+		}
+	}
+	if err := checkProtocolRange(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseProxyProtocolMode(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkTransparent(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadListenTLS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkBackendAffinity(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseMirrorDirection(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initSentry(); err != nil {
+		log.Fatal(err)
+	}
+	if err := initWebhook(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseBackends(); err != nil && (*mode == "entry" || *checkOnly || *replayFile != "") {
+		log.Fatal(err)
+	}
+	if *muxEnabled && *mode == "entry" && handshakeEnabled() {
+		log.Fatal("-mux does not support -parse-handshake, the username lists, the protocol range, -status-cache-ttl or -count-after-handshake")
+	}
+	switch {
+	case *wsPoolSize < 0:
+		log.Fatalf("-ws-pool-size must not be negative, got %d", *wsPoolSize)
+	case *wsPoolSize > 0 && *muxEnabled:
+		log.Fatal("-ws-pool-size has no use with -mux, which already keeps its session open")
+	case *wsPoolSize > 0 && *proxyHello:
+		// The exit waits only handshakeReadTimeout for the hello.
+		log.Fatal("-ws-pool-size does not work with -proxy-hello")
+	}
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadExpectedEntries(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTargetAllowlist(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRootResponse(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStatusFavicon(); err != nil {
+		log.Fatal("load status favicon: ", err)
+	}
+	if err := checkWSHost(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDialProxy(); err != nil {
+		log.Fatal(err)
+	}
+	if entryTLSConfig, err = buildEntryTLSConfig(); err != nil {
+		log.Fatal("TLS config: ", err)
+	}
+
+	if *checkOnly {
+		os.Exit(runCheck())
+	}
+	if *replayFile != "" {
+		os.Exit(runReplay())
+	}
+	if err := openCapture(); err != nil {
+		log.Fatal("open capture file: ", err)
+	}
+	watchDrainSignal()
+	watchExitSignals()
+	if *adminAddr != "" {
+		go runAdmin()
+	}
 
 	switch *mode {
 	case "entry":
@@ -66,6 +433,7 @@ func main() {
 	default:
 		log.Fatalf("unknown mode: %s (must be entry or exit)", *mode)
 	}
+	logSummary("stopped serving")
 }
 
 ///////////////////////
@@ -73,252 +441,820 @@ func main() {
 ///////////////////////
 
 func runEntry() {
-	ln, err := net.Listen("tcp", *entryListenAddr)
+	ln, err := listen(*entryListenAddr)
 	if err != nil {
-		log.Fatal("TCP listen error:", err)
+		log.Fatal("listen error:", err)
+	}
+	log.Printf("[ENTRY] Listening on %s, forwarding to %s\n", ln.Addr(), *entryWsServerURL)
+	if *muxEnabled {
+		go entryMux.run()
+	}
+	if *wsPoolSize > 0 {
+		go entryPool.run()
 	}
-	log.Printf("[ENTRY] Listening on %s, forwarding to %s\n", *entryListenAddr, *entryWsServerURL)
 
+	// With -accept-concurrency the loop stops accepting while all slots are
+	// busy, leaving new connections in the kernel backlog.
+	var slots chan struct{}
+	if *acceptConcurrency > 0 {
+		slots = make(chan struct{}, *acceptConcurrency)
+	}
+
+	var backoff time.Duration
 	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("[ENTRY] Accept error:", err)
+			if slots != nil {
+				<-slots
+			}
+			var ok bool
+			if ln, ok = acceptRetry(ln, err, &backoff); !ok {
+				return
+			}
 			continue
 		}
-		log.Println("[ENTRY] New player from", conn.RemoteAddr())
-		go handleEntryConn(conn)
+		backoff = 0
+		if draining.Load() {
+			reject(rejectDraining, "[ENTRY]", "draining, closing new connection from", conn.RemoteAddr())
+			_ = conn.Close()
+			if slots != nil {
+				<-slots
+			}
+			continue
+		}
+		go func() {
+			defer recoverConn("[ENTRY]", conn.RemoteAddr(), func() { _ = conn.Close() })
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			if *transparent {
+				conn = acceptTransparent(conn)
+			}
+			if *proxyProtocolMode != "off" {
+				pc, err := acceptProxyHeader(conn)
+				if err != nil {
+					reject(rejectProxyProtocol, "[ENTRY]", "PROXY header from", conn.RemoteAddr(), "closing:", err)
+					_ = conn.Close()
+					return
+				}
+				conn = pc
+			}
+			if country, refused := countryRefused(conn.RemoteAddr()); refused {
+				refuseCountry(conn, country)
+				_ = conn.Close()
+				return
+			}
+			if listenTLSConfig != nil {
+				tc, err := acceptTLS(conn)
+				if err != nil {
+					reject(rejectListenTLS, "[ENTRY]", "TLS handshake from", conn.RemoteAddr(), "failed:", err)
+					_ = conn.Close()
+					return
+				}
+				conn = tc
+			}
+			if !*countAfterHandshake {
+				logNewPlayer(conn)
+			}
+			if *muxEnabled {
+				handleMuxEntryConn(conn)
+			} else {
+				handleEntryConn(conn)
+			}
+		}()
+	}
+}
+
+// recoverConn is deferred first thing in each per-connection goroutine so
+// that a panic while serving one player is logged and ends only that
+// connection. Deferred closes further down have already run by the time it
+// recovers; closeFn, if not nil, covers sockets opened before those.
+func recoverConn(tag string, remote any, closeFn func()) {
+	if p := recover(); p != nil {
+		proxy.LogPanic(fmt.Sprint(tag, " connection from ", remote), p)
+		if closeFn != nil {
+			closeFn()
+		}
 	}
 }
 
 func handleEntryConn(tcpConn net.Conn) {
 	defer tcpConn.Close()
-	if c, ok := tcpConn.(*net.TCPConn); ok {
-		c.SetNoDelay(true)
+	if c, ok := proxy.InnerConn(tcpConn).(*net.TCPConn); ok {
+		c.SetNoDelay(*tcpNoDelay)
 	}
 
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: *entrySkipTLS,
-		},
+	if isSelfDial(tcpConn) {
+		reject(rejectLoop, "[ENTRY]", "LOOP DETECTED: connection from", tcpConn.RemoteAddr(), "is our own WebSocket dial; check that -ws does not point at -listen")
+		return
+	}
+
+	playerConn := tcpConn
+	var hello *clientHello
+	if handshakeEnabled() {
+		timeout := handshakeReadTimeout
+		if *handshakeTimeout > 0 {
+			timeout = min(timeout, *handshakeTimeout)
+		}
+		_ = tcpConn.SetReadDeadline(time.Now().Add(timeout))
+		h, consumed, err := readClientHello(tcpConn)
+		_ = tcpConn.SetReadDeadline(time.Time{})
+		hello = h
+		tcpConn = newPrefixConn(tcpConn, consumed)
+		if err != nil && !errors.Is(err, errLegacyPing) && *countAfterHandshake {
+			countProbe(tcpConn, err)
+			return
+		}
+		if *countAfterHandshake {
+			logNewPlayer(tcpConn)
+		}
+		if err != nil && !errors.Is(err, errLegacyPing) {
+			if handshakeFilterEnabled() {
+				reject(rejectHandshake, "[ENTRY]", "handshake error from", tcpConn.RemoteAddr(), "closing:", err)
+				return
+			}
+			if *debug {
+				log.Println("[ENTRY] Handshake error from", tcpConn.RemoteAddr(), "forwarding as is:", err)
+			}
+		}
+		if hello != nil && protocolFilterEnabled() && !protocolAllowed(hello.ProtocolVersion) {
+			switch hello.NextState {
+			case mcStateLogin, mcStateTransfer:
+				reject(rejectProtocol, "[ENTRY]", fmt.Sprintf("refused protocol %d from %s", hello.ProtocolVersion, tcpConn.RemoteAddr()))
+				_ = writeLoginDisconnect(tcpConn, *protocolRejectText)
+				return
+			case mcStateStatus:
+				if *protocolStatusReply {
+					_ = playerConn.SetDeadline(time.Now().Add(handshakeReadTimeout))
+					if err := serveStatus(playerConn, playerConn, protocolRejectStatus()); err != nil && *debug {
+						log.Println("[ENTRY] protocol status ping:", err)
+					}
+					return
+				}
+			}
+		}
+		if hello != nil && hello.Username != "" && !usernameAllowed(hello.Username) {
+			reject(rejectUsername, "[ENTRY]", fmt.Sprintf("refused player %q from %s", hello.Username, tcpConn.RemoteAddr()))
+			_ = writeLoginDisconnect(tcpConn, *usernameRejectText)
+			return
+		}
+	}
+
+	var sniff *statusSniffer
+	if hello != nil && hello.NextState == mcStateStatus && *statusCacheTTL > 0 {
+		if status := cachedStatusFor(hello); status != nil {
+			statusCacheHits.Add(1)
+			if *debug {
+				log.Println("[ENTRY] Status ping from", tcpConn.RemoteAddr(), "answered from cache")
+			}
+			_ = playerConn.SetDeadline(time.Now().Add(handshakeReadTimeout))
+			if err := serveStatus(playerConn, playerConn, status); err != nil && *debug {
+				log.Println("[ENTRY] cached status ping:", err)
+			}
+			return
+		}
+		statusCacheMisses.Add(1)
+		sniff = &statusSniffer{host: hello.ServerAddress}
 	}
 
-	ws, _, err := dialer.Dial(*entryWsServerURL, nil)
+	dialCtx, abortDial := context.WithCancel(context.Background())
+	var gone func()
+	if *abortDialOnClose {
+		gone = abortDial
+	}
+	var pre *preconnect
+	var watch *playerWatch
+	if *preconnectBuffer > 0 && !handshakeEnabled() {
+		pre = startPreconnect(tcpConn, *preconnectBuffer, gone)
+	} else if gone != nil {
+		watch = startPlayerWatch(tcpConn, gone)
+	}
+	ws, backendURL, err := dialPlayerBackend(dialCtx, tcpConn.RemoteAddr(), tcpConn.LocalAddr())
+	playerGone := dialCtx.Err() != nil
+	abortDial()
+	if watch != nil {
+		tcpConn = newPrefixConn(tcpConn, watch.stop())
+	}
+	if playerGone {
+		abortedDials.Add(1)
+		if *debug {
+			log.Println("[ENTRY] Player", tcpConn.RemoteAddr(), "disconnected during the WS dial, giving it up")
+		}
+		if ws != nil {
+			ws.Close()
+		}
+		if pre != nil {
+			_, _ = pre.stop()
+		}
+		return
+	}
+	if pre != nil {
+		early, perr := pre.stop()
+		if perr != nil {
+			reject(rejectLimit, "[ENTRY]", "closing", tcpConn.RemoteAddr().String()+":", perr)
+			if ws != nil {
+				ws.Close()
+			}
+			return
+		}
+		tcpConn = newPrefixConn(tcpConn, early)
+	}
 	if err != nil {
-		log.Println("[ENTRY] Dial WS backend error:", err)
+		reject(rejectBackendDial, "[ENTRY]", "dial WS backend", dialErrKind(err)+":", err)
+		if hello != nil {
+			_ = playerConn.SetDeadline(time.Now().Add(handshakeReadTimeout))
+			serveOffline(playerConn, playerConn, hello)
+		}
 		return
 	}
-	log.Println("[ENTRY] Connected to WS backend", *entryWsServerURL)
+	logInfo("[ENTRY] Connected to WS backend", backendURL)
 	defer ws.Close()
 
-	bridgeTCPAndWS(tcpConn, ws, "[ENTRY]")
+	info := newConnInfo("entry", tcpConn.RemoteAddr().String(), backendURL)
+	if sniff != nil {
+		sniff.info = info
+		info.statusSniff = sniff
+	}
+	notifyConnect(info)
+	for attempt := 0; ; attempt++ {
+		err = bridgeTCPAndWS(context.Background(), tcpConn, ws, info, "[ENTRY]")
+		var fwErr *proxy.FirstWriteError
+		if !errors.As(err, &fwErr) {
+			break
+		}
+		if attempt >= *firstWriteRetries {
+			log.Println("[ENTRY] First write to WS backend failed:", err)
+			break
+		}
+		log.Println("[ENTRY] First write to WS backend failed, redialing:", err)
+		var dialErr error
+		if ws, info.Backend, dialErr = dialPlayerBackend(context.Background(), tcpConn.RemoteAddr(), tcpConn.LocalAddr()); dialErr != nil {
+			log.Println("[ENTRY] Dial WS backend", dialErrKind(dialErr)+":", dialErr)
+			break
+		}
+		tcpConn = newPrefixConn(tcpConn, fwErr.Data)
+	}
+	notifyDisconnect(info, err)
 
-	log.Println("[ENTRY] Connection closed for player", tcpConn.RemoteAddr())
+	logInfo("[ENTRY] Connection closed for player", tcpConn.RemoteAddr())
 }
 
-///////////////////////
-//  出口机：WebSocket <-> 本地MC TCP
-///////////////////////
+// dialPlayerBackend is dialBackend followed by the -proxy-hello for player.
+// With -transparent, dst (the address the player dialed) goes along in the
+// upgrade request; nil sends nothing.
+func dialPlayerBackend(ctx context.Context, player, dst net.Addr) (*websocket.Conn, string, error) {
+	var ws *websocket.Conn
+	var url string
+	var err error
+	if *transparent && dst != nil {
+		h := backendHeader()
+		h.Set(origDstHeader, dst.String())
+		ws, url, err = dialBackendHeader(ctx, h, affinityKey(player))
+	} else {
+		ws, url, err = dialBackend(ctx, affinityKey(player))
+	}
+	if err != nil || !*proxyHello {
+		return ws, url, err
+	}
+	if err := sendProxyHello(ws, player); err != nil {
+		ws.Close()
+		return nil, url, fmt.Errorf("send proxy hello: %w", err)
+	}
+	return ws, url, nil
+}
 
-func runExit() {
-	http.HandleFunc("/ws", handleExitWS)
+// entryTLSConfig is built from the TLS flags at startup.
+var entryTLSConfig *tls.Config
 
-	log.Printf("[EXIT] Listening on %s (WebSocket), forwarding to %s\n", *exitListenAddr, *exitTargetAddr)
-	err := http.ListenAndServe(*exitListenAddr, nil)
-	if err != nil {
-		log.Fatal("[EXIT] ListenAndServe error:", err)
+func buildEntryTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: *entrySkipTLS,
+		ServerName:         *entryWsSNI,
 	}
+	var err error
+	if cfg.MinVersion, err = parseTLSVersion(*tlsMinVersion); err != nil {
+		return nil, err
+	}
+	if cfg.CipherSuites, err = parseCipherSuites(*tlsCipherSuites); err != nil {
+		return nil, err
+	}
+	if cfg.CipherSuites != nil && cfg.MinVersion >= tls.VersionTLS13 {
+		log.Println("[ENTRY] -tls-cipher-suites has no effect with -tls-min-version 1.3")
+	}
+	if *entryCAFile != "" {
+		pem, err := os.ReadFile(*entryCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *entryCAFile)
+		}
+		cfg.RootCAs = pool
+		if *entrySkipTLS {
+			log.Println("[ENTRY] -ca-file has no effect while -skip-tls-verify is true")
+		}
+	}
+	return cfg, nil
 }
 
-func handleExitWS(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("[EXIT] WebSocket upgrade error:", err)
-		return
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
 	}
-	log.Println("[EXIT] New WS connection from", r.RemoteAddr)
-	defer ws.Close()
+	return 0, fmt.Errorf("-tls-min-version must be 1.2 or 1.3, got %q", v)
+}
 
-	tcpConn, err := net.Dial("tcp", *exitTargetAddr)
-	if err != nil {
-		log.Println("[EXIT] Dial TCP target error:", err)
-		return
+// parseCipherSuites maps -tls-cipher-suites names to IDs. Only the suites Go
+// considers secure are accepted.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
 	}
-	log.Println("[EXIT] Connected to TCP target", *exitTargetAddr)
-	defer tcpConn.Close()
-
-	if c, ok := tcpConn.(*net.TCPConn); ok {
-		c.SetNoDelay(true)
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
 	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("-tls-cipher-suites: unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
-	bridgeTCPAndWS(tcpConn, ws, "[EXIT]")
-
-	log.Println("[EXIT] WS connection closed from", r.RemoteAddr)
+// dialBackend opens the WebSocket to the exit and returns the -ws URL it
+// picked. With -ws-srv the TCP connection goes to the SRV target, while TLS
+// SNI and the Host header still use the hostname from -ws. A non-empty
+// affinity is the -backend-affinity key of the player (see pickBackendFor).
+func dialBackend(ctx context.Context, affinity string) (*websocket.Conn, string, error) {
+	if *wsPoolSize > 0 {
+		if ws, url := entryPool.get(); ws != nil {
+			return ws, url, nil
+		}
+	}
+	return dialBackendHeader(ctx, backendHeader(), affinity)
 }
 
-///////////////////////
-//  通用复制函数（参考 wsmc WebSocketHandler）
-///////////////////////
+// dialBackendHeader is dialBackend with the upgrade request headers given
+// by the caller.
+func dialBackendHeader(ctx context.Context, header http.Header, affinity string) (*websocket.Conn, string, error) {
+	b, err := pickBackendFor(affinity)
+	if err != nil {
+		return nil, "", err
+	}
+	ws, err := dialURL(ctx, b.URL, header)
+	if ctx.Err() == nil {
+		// A dial the caller gave up on says nothing about the backend.
+		b.report(err)
+	}
+	return ws, b.URL, err
+}
 
-func bridgeTCPAndWS(tcpConn net.Conn, ws *websocket.Conn, tag string) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// tcpDialNetwork applies -dial-network to a "tcp" dial; unix sockets and
+// dials that already name a family are left alone.
+func tcpDialNetwork(network string) string {
+	if network == "tcp" {
+		return *dialNetwork
+	}
+	return network
+}
 
-	ws.SetReadLimit(*maxFramePayload)
-	ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
-	ws.SetPongHandler(func(string) error {
-		ws.SetReadDeadline(time.Now().Add(wsReadTimeout))
-		return nil
-	})
+// dialURL dials one -ws backend, giving up early if ctx is done.
+func dialURL(ctx context.Context, wsURL string, header http.Header) (*websocket.Conn, error) {
+	return dialURLWrap(ctx, wsURL, header, nil)
+}
 
-	errCh := make(chan error, 3)
-	var wg sync.WaitGroup
-	var wsWriteMu sync.Mutex
+// dialURLWrap is dialURL with wrap, if not nil, applied to the TCP
+// connection before TLS and the WebSocket handshake run over it.
+func dialURLWrap(ctx context.Context, wsURL string, header http.Header, wrap func(net.Conn) net.Conn) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		Proxy:            dialProxyFunc(),
+		HandshakeTimeout: *entryDialTimeout,
+		TLSClientConfig:  entryTLSConfig,
+		ReadBufferSize:   *wsReadBuffer,
+		WriteBufferSize:  *wsWriteBuffer,
+		WriteBufferPool:  &wsWriteBufferPool,
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errCh <- copyTCPToWS(ctx, tcpConn, ws, &wsWriteMu, tag)
-	}()
+	d := net.Dialer{Timeout: *entryDialTimeout}
+	netDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFunc(ctx, &d, tcpDialNetwork(network), addr)
+	}
+	if *entryWsSRV != "" {
+		if target, ok := lookupWSSRV(wsURL); ok {
+			netDial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialFunc(ctx, &d, tcpDialNetwork(network), target)
+			}
+		}
+	}
+	inner := netDial
+	netDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := inner(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c = wrapWriteRetry(c, "[ENTRY]")
+		if wrap != nil {
+			c = wrap(c)
+		}
+		return c, nil
+	}
+	var dialDone func()
+	dialer.NetDialContext, dialDone = trackDial(netDial)
+	defer dialDone()
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errCh <- copyWSToTCP(ctx, ws, tcpConn, tag)
-	}()
+	ctx, cancel := context.WithTimeout(ctx, *entryDialTimeout)
+	defer cancel()
+	ws, _, err := wsDialFunc(ctx, &dialer, wsURL, header)
+	if err == nil && (*logTLS || *debug) {
+		logTLSState(ws)
+	}
+	return ws, err
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		errCh <- wsPingLoop(ctx, ws, &wsWriteMu, tag)
-	}()
+// logTLSState logs what the TLS handshake with the WebSocket backend
+// negotiated. Plain ws:// connections log nothing.
+func logTLSState(ws *websocket.Conn) {
+	tc, ok := ws.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return
+	}
+	st := tc.ConnectionState()
+	alpn := st.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "none"
+	}
+	msg := fmt.Sprintf("[ENTRY] Backend TLS: %s, %s, ALPN %s", tls.VersionName(st.Version), tls.CipherSuiteName(st.CipherSuite), alpn)
+	if len(st.PeerCertificates) > 0 {
+		cert := st.PeerCertificates[0]
+		msg += fmt.Sprintf(", peer %q issued by %q", cert.Subject.String(), cert.Issuer.String())
+	}
+	log.Println(msg)
+}
 
-	firstErr := <-errCh
-	cancel()
+// lookupWSSRV resolves "<-ws-srv>.<host>" and returns the preferred target.
+// net.LookupSRV already orders records by priority and shuffles by weight.
+func lookupWSSRV(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	name := strings.TrimSuffix(*entryWsSRV, ".") + "." + u.Hostname()
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil || len(addrs) == 0 {
+		if *debug {
+			log.Printf("[ENTRY] SRV lookup %s failed, using %s directly: %v", name, u.Host, err)
+		}
+		return "", false
+	}
+	target := net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."), strconv.Itoa(int(addrs[0].Port)))
+	if *debug {
+		log.Printf("[ENTRY] SRV %s -> %s", name, target)
+	}
+	return target, true
+}
 
-	_ = tcpConn.SetDeadline(time.Now())
-	_ = ws.SetReadDeadline(time.Now())
+///////////////////////
+//  出口机：WebSocket <-> 本地MC TCP
+///////////////////////
 
-	wsWriteMu.Lock()
-	_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeWait))
-	wsWriteMu.Unlock()
+func runExit() {
+	http.HandleFunc("/ws", handleExitWS)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	if rootBody != nil {
+		http.HandleFunc("/", handleRoot)
+	}
+	if probingTarget() {
+		go runStartupProbe()
+	}
 
-	_ = ws.Close()
-	_ = tcpConn.Close()
+	ln, err := listen(*exitListenAddr)
+	if err != nil {
+		log.Fatal("[EXIT] listen error:", err)
+	}
+	if *dynamicTarget != "" {
+		log.Printf("[EXIT] Listening on %s (WebSocket), forwarding to the target named by %s\n", ln.Addr(), *dynamicTarget)
+	} else {
+		log.Printf("[EXIT] Listening on %s (WebSocket), forwarding to %s\n", ln.Addr(), *exitTargetAddr)
+	}
+	if *writeTimeoutRetries > 0 {
+		ln = retryListener{Listener: ln, tag: "[EXIT]"}
+	}
+	exitServer = &http.Server{
+		MaxHeaderBytes:    *maxHeaderBytes,
+		ReadHeaderTimeout: *readHeaderTimeout,
+	}
+	err = exitServer.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("[EXIT] Serve error:", err)
+	}
+}
 
-	wg.Wait()
+// exitServer serves the exit's WebSocket endpoint; Shutdown stops it
+// accepting upgrades. Upgraded connections are hijacked and not affected.
+var exitServer *http.Server
 
-	if firstErr != nil && !errors.Is(firstErr, context.Canceled) && !errors.Is(firstErr, io.EOF) {
-		log.Println(tag, "bridge closed:", firstErr)
+// servePlainRequest answers a request to /ws that is not a WebSocket
+// upgrade, typically a health probe, quietly instead of as a failed upgrade.
+func servePlainRequest(w http.ResponseWriter, r *http.Request, client string) {
+	if *debug {
+		log.Println("[EXIT] Plain", r.Method, "request to", r.URL.Path, "from", client)
 	}
+	if *plainRequestStatus == http.StatusUpgradeRequired {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "ok\n")
 }
 
-func copyTCPToWS(ctx context.Context, tcp net.Conn, ws *websocket.Conn, wsMu *sync.Mutex, tag string) error {
-	buf := make([]byte, 8192)
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+func handleExitWS(w http.ResponseWriter, r *http.Request) {
+	// net/http would recover a panic here too; this logs it like the
+	// entry does.
+	client := clientAddr(r)
+	defer recoverConn("[EXIT]", client, nil)
+	if draining.Load() {
+		reject(rejectDraining, "[EXIT]", "draining, refusing", client)
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		servePlainRequest(w, r, client)
+		return
+	}
+	if isLoopRequest(r) {
+		refuseLoop(w, r)
+		return
+	}
+	if !checkEntrySource(w, r, client) {
+		return
+	}
+	if !checkExitBasicAuth(w, r) || !checkAuthToken(w, r) {
+		return
+	}
+	releaseSlot, ok := acquireConnSlot()
+	if !ok {
+		reject(rejectLimit, "[EXIT]", "upgrade from", client+":", "all", *maxConnections, "connections in use (-max-connections)")
+		http.Error(w, "at connection limit", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseSlot()
+	release, ok := acquireIPSlot(client)
+	if !ok {
+		reject(rejectLimit, "[EXIT]", "upgrade from", client+":", "already", *maxConnsPerIP, "connections from its IP (-max-conns-per-ip)")
+		http.Error(w, "too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	target, err := requestTarget(r)
+	if err != nil {
+		reject(rejectTargetDenied, "[EXIT]", "upgrade from", client+":", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, errTargetNotAllowed) {
+			status = http.StatusForbidden
 		}
-
-		_ = tcp.SetReadDeadline(time.Now().Add(tcpReadTimeout))
-		n, err := tcp.Read(buf)
-		if err != nil {
-			return fmt.Errorf("%s TCP read: %w", tag, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if r.Header.Get(muxHeader) != "" {
+		if !*muxEnabled {
+			reject(rejectLimit, "[EXIT]", "mux session from", client, "but -mux is off")
+			http.Error(w, "mux not enabled on this exit", http.StatusBadRequest)
+			return
 		}
-		if n <= 0 {
-			continue
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			reject(rejectUpgrade, "[EXIT]", "WebSocket upgrade error:", err)
+			return
 		}
+		serveMuxExit(r.Context(), ws, client, target, localAddr(r))
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		reject(rejectUpgrade, "[EXIT]", "WebSocket upgrade error:", err)
+		return
+	}
+	logInfo("[EXIT] New WS connection from", client)
+	defer ws.Close()
 
-		slice := buf[:n]
-		if *debug || *dumpBytes {
-			log.Printf("%s TCP->WS (%d)", tag, n)
+	remote := client
+	if *proxyHello {
+		player, err := readProxyHello(ws)
+		if err != nil {
+			reject(rejectProxyHello, "[EXIT]", "proxy hello from", client+":", err)
+			return
 		}
-		if *dumpBytes {
-			dumpHex(slice)
+		if player != "" {
+			logInfo("[EXIT] Player address from proxy hello:", player)
+			remote = player
 		}
+	}
 
-		wsMu.Lock()
-		_ = ws.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
-		err = ws.WriteMessage(websocket.BinaryMessage, slice)
-		wsMu.Unlock()
-		if err != nil {
-			return fmt.Errorf("%s WS write: %w", tag, err)
+	tcpConn, err := dialTargetFor(target, remote, localAddr(r))
+	if errors.Is(err, errTargetNotAllowed) {
+		reject(rejectTargetDenied, "[EXIT]", err)
+		_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "target not allowed"), time.Now().Add(proxy.CloseWait))
+		return
+	}
+	if err != nil {
+		reject(rejectTargetDial, "[EXIT]", "dial TCP target", dialErrKind(err)+":", err)
+		if handshakeEnabled() {
+			serveOfflineWS(ws)
 		}
+		return
+	}
+	logInfo("[EXIT] Connected to TCP target", target)
+	if *targetReconnectWindow > 0 {
+		redial := func() (net.Conn, error) { return dialTargetFor(target, remote, localAddr(r)) }
+		tcpConn = newRedialConn(tcpConn, redial, *targetReconnectWindow)
 	}
+	defer tcpConn.Close()
+
+	info := newConnInfo("exit", remote, target)
+	notifyConnect(info)
+	err = bridgeTCPAndWS(r.Context(), tcpConn, ws, info, "[EXIT]")
+	notifyDisconnect(info, err)
+
+	logInfo("[EXIT] WS connection closed from", client)
 }
 
-func copyWSToTCP(ctx context.Context, ws *websocket.Conn, tcp net.Conn, tag string) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
+// localAddr is the exit address r came in on, or nil if net/http did not
+// record it.
+func localAddr(r *http.Request) net.Addr {
+	a, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return a
+}
 
-		msgType, data, err := ws.ReadMessage()
-		if err != nil {
-			return fmt.Errorf("%s WS read: %w", tag, err)
-		}
+// dialTarget opens a connection to target (-exit-target or the
+// -dynamic-target header), subject to -target-allowlist: a target listed by
+// name is dialed as is, any other is only connected if its resolved address
+// is allowed.
+func dialTarget(target string) (net.Conn, error) {
+	network, addr := splitNetAddr(target)
+	d := net.Dialer{Timeout: *exitDialTimeout}
+	if allowedTargets != nil && !allowedTargets.allowsName(target) {
+		d.Control = allowedTargets.control
+	}
+	c, err := dialFunc(context.Background(), &d, tcpDialNetwork(network), addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(*tcpNoDelay)
+	}
+	targetReached.Store(true)
+	return c, nil
+}
 
-		switch msgType {
-		case websocket.BinaryMessage:
-			if *debug || *dumpBytes {
-				log.Printf("%s WS->TCP (%d)", tag, len(data))
-			}
-			if *dumpBytes {
-				dumpHex(data)
-			}
+///////////////////////
+//  通用复制函数（参考 wsmc WebSocketHandler），实现见 proxy 包
+///////////////////////
 
-			_ = tcp.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
-			if _, err := tcp.Write(data); err != nil {
-				return fmt.Errorf("%s TCP write: %w", tag, err)
-			}
-		case websocket.CloseMessage:
-			return io.EOF
-		case websocket.TextMessage:
-			// ignore text frames as in wsmc
-			continue
-		default:
-			if *debug {
-				log.Printf("%s unsupported WS frame type: %d", tag, msgType)
-			}
-		}
+// bridgeTCPAndWS runs proxy.Bridge for one connection, registered with the
+// admin API for its duration. The exit passes the upgrade request's context,
+// so canceling it on the HTTP server side tears the bridge down; the entry
+// has none and passes context.Background.
+func bridgeTCPAndWS(ctx context.Context, tcpConn net.Conn, ws *websocket.Conn, info *connInfo, tag string) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	registerConn(info, func() { cancel(errAdminClose) })
+	defer unregisterConn(info)
+
+	cfg := bridgeConfig(info, tag)
+	if info.Mode == "entry" && *mirrorWS != "" {
+		m := startMirror(info.ID)
+		defer m.close()
+		cfg.Capture = chainCapture(cfg.Capture, m.tap)
+	}
+	if info.statusSniff != nil {
+		cfg.Capture = chainCapture(cfg.Capture, info.statusSniff.tap)
+	}
+	err := proxy.Bridge(ctx, tcpConn, ws, cfg)
+	if errors.Is(err, proxy.ErrMemoryLimit) {
+		memoryLimitCloses.Add(1)
 	}
+	if errors.Is(err, proxy.ErrReassemblyLimit) {
+		reassemblyLimitCloses.Add(1)
+	}
+	reportBridgeError(err, info)
+	return err
 }
 
-func wsPingLoop(ctx context.Context, ws *websocket.Conn, wsMu *sync.Mutex, tag string) error {
-	ticker := time.NewTicker(*pingInterval)
-	defer ticker.Stop()
+// chainCapture returns a Capture hook calling a (if set), then b.
+func chainCapture(a, b func(toTCP bool, data []byte)) func(toTCP bool, data []byte) {
+	if a == nil {
+		return b
+	}
+	return func(toTCP bool, data []byte) {
+		a(toTCP, data)
+		b(toTCP, data)
+	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			wsMu.Lock()
-			err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(tcpWriteTimeout))
-			wsMu.Unlock()
-			if err != nil {
-				return fmt.Errorf("%s WS ping: %w", tag, err)
-			}
-		}
+// memoryLimitCloses counts bridges ended by -max-conn-memory.
+var memoryLimitCloses atomic.Uint64
+
+// reassemblyLimitCloses counts bridges ended by -max-total-reassembly.
+var reassemblyLimitCloses atomic.Uint64
+
+// globalReassembly tracks the WebSocket messages held by all bridges, for
+// -max-total-reassembly and /metrics.
+var globalReassembly *proxy.Reassembly
+
+// globalLimiter is built from -global-rate-limit; nil means unlimited.
+var globalLimiter *proxy.RateLimiter
+
+// textPolicy is -on-text-frame, parsed at startup.
+var textPolicy proxy.TextPolicy
+
+func parseTextPolicy(s string) (proxy.TextPolicy, error) {
+	switch s {
+	case "ignore":
+		return proxy.TextIgnore, nil
+	case "log":
+		return proxy.TextLog, nil
+	case "error":
+		return proxy.TextError, nil
+	case "forward":
+		return proxy.TextForward, nil
 	}
+	return 0, fmt.Errorf("-on-text-frame must be ignore, log, error or forward, got %q", s)
 }
 
-func dumpHex(data []byte) {
-	const maxPerLine = 32
-	for i := 0; i < len(data); i += maxPerLine {
-		end := i + maxPerLine
-		if end > len(data) {
-			end = len(data)
+// bridgeConfig fills a proxy.Config from the flags.
+func bridgeConfig(info *connInfo, tag string) proxy.Config {
+	cfg := proxy.Config{
+		Tag:                tag,
+		MaxFramePayload:    *maxFramePayload,
+		ReadBufferSize:     *readBufferSize,
+		WriteQueueSize:     *writeQueueSize,
+		MaxConnMemory:      *maxConnMemory,
+		CoalesceDelay:      *coalesceDelay,
+		MaxTCPWrite:        *maxTCPWrite,
+		HalfClose:          *halfClose,
+		CorkWrites:         *corkWrites,
+		StreamFrames:       *streamFrames,
+		StrictFrames:       *strictFrames,
+		MaxFPS:             *maxFPS,
+		FPSClose:           *fpsAction == "close",
+		RateLimit:          globalLimiter,
+		Reassembly:         globalReassembly,
+		TCPReadTimeout:     *tcpReadTimeout,
+		TCPWriteIdle:       *tcpWriteIdle,
+		WSReadTimeout:      *wsReadTimeout,
+		PingInterval:       *pingInterval,
+		PingJitter:         *pingJitter,
+		MaxLifetime:        *maxConnLifetime,
+		CloseTimeout:       *closeTimeout,
+		SkipCloseHandshake: *skipCloseHandshake,
+		Debug:              *debug,
+		DumpBytes:          *dumpBytes,
+		DumpWidth:          *dumpWidth,
+		ConnID:             info.ID,
+		TextFrames:         textPolicy,
+		Counters:           &info.Counters,
+	}
+	if *e2eRTT {
+		cfg.OnRTT = recordRTT(info, tag)
+	}
+	if capture.w != nil {
+		cfg.Capture = func(toTCP bool, data []byte) {
+			dir := byte(captureToWS)
+			if toTCP {
+				dir = captureToTCP
+			}
+			captureRecord(info.ID, dir, data)
 		}
-		line := data[i:end]
-		out := make([]byte, 0, len(line)*3)
-		for _, b := range line {
-			out = append(out, fmt.Sprintf("%02X ", b)...)
+	}
+	if info.Mode == "exit" {
+		cfg.WSHandshakeTimeout = *handshakeTimeout
+	} else {
+		cfg.TCPHandshakeTimeout = *handshakeTimeout
+	}
+	if *statsChannel {
+		if info.Mode == "exit" {
+			cfg.Stats = func() []byte { return statsFrame(info) }
+			cfg.StatsInterval = statsInterval
+		} else {
+			cfg.OnText = func(data []byte) { handleStatsFrame(info, data, tag) }
 		}
-		log.Printf("%s", string(out))
 	}
+	return cfg
 }
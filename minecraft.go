@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+///////////////////////
+//  Minecraft 握手解析（仅未加密、未压缩的开头几个包）
+///////////////////////
+
+const (
+	mcStateStatus   = 1
+	mcStateLogin    = 2
+	mcStateTransfer = 3
+
+	// Handshake and Login Start are tiny; anything bigger is not a client
+	// we want to parse.
+	mcMaxHandshakePacket = 32 * 1024
+	mcMaxUsernameBytes   = 16 * 4
+
+	handshakeReadTimeout = 10 * time.Second
+)
+
+var (
+	errVarIntTooBig = errors.New("varint too big")
+	errPacketTooBig = errors.New("packet too big")
+	errLegacyPing   = errors.New("legacy server list ping")
+)
+
+// mcHandshake is the serverbound Handshake packet (id 0x00).
+type mcHandshake struct {
+	ProtocolVersion int32
+	ServerAddress   string
+	ServerPort      uint16
+	NextState       int32
+}
+
+// clientHello is what the entry learned from the start of the player's
+// stream: the handshake and, for login, the username from Login Start.
+type clientHello struct {
+	mcHandshake
+	Username string
+}
+
+// packetReader reads packets straight from the connection and remembers
+// every byte it consumed so they can be replayed to the backend untouched.
+type packetReader struct {
+	r   io.Reader
+	raw []byte
+}
+
+func (p *packetReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(p.r, b[:]); err != nil {
+		return 0, err
+	}
+	p.raw = append(p.raw, b[0])
+	return b[0], nil
+}
+
+func (p *packetReader) readPacket(maxLen int) (int32, []byte, error) {
+	length, err := readVarInt(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length <= 0 || int(length) > maxLen {
+		return 0, nil, fmt.Errorf("%w: %d bytes", errPacketTooBig, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return 0, nil, err
+	}
+	p.raw = append(p.raw, body...)
+
+	buf := &byteBuf{b: body}
+	id, err := readVarInt(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, buf.b, nil
+}
+
+// readClientHello parses the Handshake and, in login state, the Login Start
+// packet. It returns the bytes it consumed, which must be replayed before
+// any further data from r. Only the username is read from Login Start;
+// the 1.19+ signature/UUID fields that follow it are left alone.
+func readClientHello(r io.Reader) (*clientHello, []byte, error) {
+	pr := &packetReader{r: r}
+	first, err := pr.ReadByte()
+	if err != nil {
+		return nil, pr.raw, err
+	}
+	if first == 0xFE {
+		return nil, pr.raw, errLegacyPing
+	}
+	// Put the byte back so readPacket sees the whole length prefix.
+	pr.r = io.MultiReader(&byteBuf{b: []byte{first}}, r)
+	pr.raw = pr.raw[:0]
+
+	id, body, err := pr.readPacket(mcMaxHandshakePacket)
+	if err != nil {
+		return nil, pr.raw, fmt.Errorf("read handshake: %w", err)
+	}
+	if id != 0x00 {
+		return nil, pr.raw, fmt.Errorf("unexpected handshake packet id 0x%02X", id)
+	}
+	hs, err := decodeHandshake(body)
+	if err != nil {
+		return nil, pr.raw, err
+	}
+	hello := &clientHello{mcHandshake: hs}
+
+	if hs.NextState == mcStateLogin || hs.NextState == mcStateTransfer {
+		id, body, err := pr.readPacket(mcMaxHandshakePacket)
+		if err != nil {
+			return hello, pr.raw, fmt.Errorf("read login start: %w", err)
+		}
+		if id != 0x00 {
+			return hello, pr.raw, fmt.Errorf("unexpected login packet id 0x%02X", id)
+		}
+		buf := &byteBuf{b: body}
+		name, err := readString(buf, mcMaxUsernameBytes)
+		if err != nil {
+			return hello, pr.raw, fmt.Errorf("read username: %w", err)
+		}
+		hello.Username = name
+	}
+	return hello, pr.raw, nil
+}
+
+func decodeHandshake(body []byte) (mcHandshake, error) {
+	var hs mcHandshake
+	buf := &byteBuf{b: body}
+
+	v, err := readVarInt(buf)
+	if err != nil {
+		return hs, fmt.Errorf("read protocol version: %w", err)
+	}
+	hs.ProtocolVersion = v
+
+	if hs.ServerAddress, err = readString(buf, 255*4); err != nil {
+		return hs, fmt.Errorf("read server address: %w", err)
+	}
+	if len(buf.b) < 2 {
+		return hs, fmt.Errorf("read server port: %w", io.ErrUnexpectedEOF)
+	}
+	hs.ServerPort = uint16(buf.b[0])<<8 | uint16(buf.b[1])
+	buf.b = buf.b[2:]
+
+	if hs.NextState, err = readVarInt(buf); err != nil {
+		return hs, fmt.Errorf("read next state: %w", err)
+	}
+	return hs, nil
+}
+
+// byteBuf is a minimal reader over a byte slice.
+type byteBuf struct {
+	b []byte
+}
+
+func (b *byteBuf) Read(p []byte) (int, error) {
+	if len(b.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.b)
+	b.b = b.b[n:]
+	return n, nil
+}
+
+func (b *byteBuf) ReadByte() (byte, error) {
+	if len(b.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := b.b[0]
+	b.b = b.b[1:]
+	return c, nil
+}
+
+// readVarInt decodes a protocol VarInt (at most 5 bytes). Values that do not
+// fit in 32 bits are rejected rather than silently truncated.
+func readVarInt(r io.ByteReader) (int32, error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 4 && b&0xF0 != 0 {
+			return 0, errVarIntTooBig
+		}
+		v |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(v), nil
+		}
+	}
+	return 0, errVarIntTooBig
+}
+
+func readString(r *byteBuf, maxLen int) (string, error) {
+	n, err := readVarInt(r)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || int(n) > maxLen || int(n) > len(r.b) {
+		return "", fmt.Errorf("bad string length %d", n)
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s, nil
+}
+
+func appendVarInt(b []byte, v int32) []byte {
+	u := uint32(v)
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(b, byte(u))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendVarInt(b, int32(len(s)))
+	return append(b, s...)
+}
+
+// writePacket writes one uncompressed packet.
+func writePacket(w io.Writer, id int32, body []byte) error {
+	payload := appendVarInt(nil, id)
+	payload = append(payload, body...)
+	pkt := appendVarInt(make([]byte, 0, len(payload)+5), int32(len(payload)))
+	pkt = append(pkt, payload...)
+	_, err := w.Write(pkt)
+	return err
+}
+
+// writeLoginDisconnect sends Disconnect (login, id 0x00) with a plain text
+// chat component, which the client shows on its "disconnected" screen.
+func writeLoginDisconnect(w io.Writer, reason string) error {
+	msg, _ := json.Marshal(map[string]string{"text": reason})
+	return writePacket(w, 0x00, appendString(nil, string(msg)))
+}
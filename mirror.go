@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	mirrorWS        = flag.String("mirror-ws", "", "on the entry, copy each player's traffic best-effort to this WebSocket URL, one connection per player (see README)")
+	mirrorDirection = flag.String("mirror-direction", "both", "what -mirror-ws receives: both | to-server | to-client")
+)
+
+///////////////////////
+//  流量镜像（-mirror-ws）
+///////////////////////
+
+const (
+	// mirrorQueueSize is how many chunks may wait for a slow mirror before
+	// new ones are dropped.
+	mirrorQueueSize    = 256
+	mirrorWriteTimeout = 10 * time.Second
+)
+
+// Direction byte in front of every mirrored message.
+const (
+	mirrorToServer = 0 // player -> server
+	mirrorToClient = 1 // server -> player
+)
+
+// mirrorDrops counts chunks dropped because a mirror was full, down or
+// could not be reached. It is exported on /metrics.
+var mirrorDrops atomic.Uint64
+
+// mirrorToServerOn and mirrorToClientOn are -mirror-direction, parsed at
+// startup.
+var mirrorToServerOn, mirrorToClientOn bool
+
+func parseMirrorDirection() error {
+	switch *mirrorDirection {
+	case "both":
+		mirrorToServerOn, mirrorToClientOn = true, true
+	case "to-server":
+		mirrorToServerOn = true
+	case "to-client":
+		mirrorToClientOn = true
+	default:
+		return fmt.Errorf("-mirror-direction must be both, to-server or to-client, got %q", *mirrorDirection)
+	}
+	return nil
+}
+
+// mirror copies one player's traffic to -mirror-ws. The bridge only ever
+// hands it chunks through a bounded queue and never waits: when the mirror
+// is slow or still dialing, chunks that do not fit are dropped, and once it
+// has failed everything is. Drops are counted.
+type mirror struct {
+	connID  uint64
+	queue   chan []byte
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped atomic.Uint64
+}
+
+func startMirror(connID uint64) *mirror {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &mirror{
+		connID: connID,
+		queue:  make(chan []byte, mirrorQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go m.run()
+	return m
+}
+
+// tap is the proxy.Config Capture hook. It copies data, since the bridge
+// reuses its buffers.
+func (m *mirror) tap(toTCP bool, data []byte) {
+	dir := byte(mirrorToServer)
+	if toTCP {
+		dir = mirrorToClient
+		if !mirrorToClientOn {
+			return
+		}
+	} else if !mirrorToServerOn {
+		return
+	}
+	if m.ctx.Err() != nil {
+		m.drop()
+		return
+	}
+	msg := make([]byte, 1+len(data))
+	msg[0] = dir
+	copy(msg[1:], data)
+	select {
+	case m.queue <- msg:
+	default:
+		m.drop()
+	}
+}
+
+func (m *mirror) drop() {
+	m.dropped.Add(1)
+	mirrorDrops.Add(1)
+}
+
+// close stops the mirror; chunks still queued are not sent.
+func (m *mirror) close() {
+	m.cancel()
+	if n := m.dropped.Load(); n > 0 {
+		log.Printf("[ENTRY] conn %d mirror dropped %d chunks", m.connID, n)
+	}
+}
+
+func (m *mirror) run() {
+	d := net.Dialer{Timeout: *entryDialTimeout}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: *entryDialTimeout,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialFunc(ctx, &d, tcpDialNetwork(network), addr)
+		},
+	}
+	ws, _, err := wsDialFunc(m.ctx, &dialer, *mirrorWS, nil)
+	if err != nil {
+		if m.ctx.Err() == nil {
+			log.Printf("[ENTRY] conn %d mirror dial %s: %v", m.connID, *mirrorWS, err)
+		}
+		m.cancel()
+		return
+	}
+	defer ws.Close()
+
+	// The mirror is write-only, but reading keeps control frames flowing
+	// and notices when the far end goes away.
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				m.cancel()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-m.queue:
+			_ = ws.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+			if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				if m.ctx.Err() == nil && *debug {
+					log.Printf("[ENTRY] conn %d mirror write: %v", m.connID, err)
+				}
+				m.drop()
+				m.cancel()
+				return
+			}
+		case <-m.ctx.Done():
+			_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
+)
+
+///////////////////////
+//  多路复用隧道（-mux）：多个 TCP 连接共用一条 WebSocket
+///////////////////////
+
+// Every binary WebSocket message in a mux session carries one or more
+// frames:
+//
+//	+--------+-----------+-----------+---------+
+//	| type   | stream ID | length    | payload |
+//	| 1 byte | 4 bytes   | 4 bytes   |         |
+//	+--------+-----------+-----------+---------+
+//
+// Integers are big-endian. Types:
+//
+//	1 OPEN   entry -> exit, empty payload: dial -exit-target for a new stream;
+//	         exit -> entry, empty payload: the target is connected
+//	2 DATA   either way: payload is bytes of the stream. The entry sends
+//	         none before the exit's OPEN, so the exit never has to buffer
+//	3 CLOSE  either way, empty payload: the stream is finished; the receiver
+//	         closes its TCP connection and forgets the ID
+//
+// Stream IDs are chosen by the entry and never reused within a session.
+// Anything malformed closes the whole session.
+
+var muxEnabled = flag.Bool("mux", false, "carry all player connections over one persistent WebSocket, reconnected with backoff (both ends must enable it; not for Minecraft handshake features)")
+
+const (
+	muxHeader = "X-Mcws-Mux" // set on the upgrade request of a mux session
+
+	muxOpen  = 1
+	muxData  = 2
+	muxClose = 3
+
+	muxFrameHeader = 9
+
+	muxBackoffMin = 500 * time.Millisecond
+	muxBackoffMax = 30 * time.Second
+	// A session that lasted this long resets the backoff.
+	muxStableSession = time.Minute
+)
+
+var (
+	errMuxFrame     = errors.New("malformed mux frame")
+	errMuxEarlyData = errors.New("data before the target connected")
+	errStreamClosed = errors.New("stream closed")
+)
+
+// muxStream is one TCP connection inside a session.
+type muxStream struct {
+	id uint32
+
+	mu     sync.Mutex
+	conn   net.Conn // nil on the exit until the target dial completes
+	info   *connInfo
+	opened bool
+	closed bool
+
+	ready chan struct{} // entry: closed when the exit's OPEN arrives
+	done  chan struct{} // closed by finish
+}
+
+func newMuxStream(id uint32, conn net.Conn, info *connInfo) *muxStream {
+	return &muxStream{id: id, conn: conn, info: info, ready: make(chan struct{}), done: make(chan struct{})}
+}
+
+// write sends DATA received from the peer to the stream's TCP connection.
+func (st *muxStream) write(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return errStreamClosed
+	}
+	if st.conn == nil {
+		return errMuxEarlyData
+	}
+	_ = st.conn.SetWriteDeadline(time.Now().Add(proxy.TCPWriteTimeout))
+	n, err := st.conn.Write(data)
+	st.info.ToTCP.Add(int64(n))
+	return err
+}
+
+// attach gives an exit stream its freshly dialed target and registers it.
+func (st *muxStream) attach(conn net.Conn, info *connInfo, cancel context.CancelFunc) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return errStreamClosed
+	}
+	st.conn, st.info = conn, info
+	registerConn(info, cancel)
+	return nil
+}
+
+// markOpened records the exit's OPEN on an entry stream.
+func (st *muxStream) markOpened() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.opened {
+		return fmt.Errorf("%w: stream %d opened twice", errMuxFrame, st.id)
+	}
+	st.opened = true
+	close(st.ready)
+	return nil
+}
+
+// muxSession is one WebSocket carrying many streams.
+type muxSession struct {
+	ws  *websocket.Conn
+	tag string
+	// onOpen is called in its own goroutine for each OPEN; nil on the
+	// entry, which does not accept streams.
+	onOpen  func(st *muxStream)
+	backend string // -ws URL the entry session is connected to
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream // nil once the session is closed
+	nextID  uint32
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func newMuxSession(ctx context.Context, ws *websocket.Conn, tag string, onOpen func(st *muxStream)) *muxSession {
+	ctx, cancel := context.WithCancel(ctx)
+	return &muxSession{
+		ws:      ws,
+		tag:     tag,
+		onOpen:  onOpen,
+		streams: make(map[uint32]*muxStream),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// run serves the session until the WebSocket fails, then closes every
+// stream on it.
+func (s *muxSession) run() error {
+	s.ws.SetReadLimit(*maxFramePayload)
+	s.ws.SetReadDeadline(proxy.ReadDeadline(*wsReadTimeout))
+	s.ws.SetPongHandler(func(string) error {
+		s.ws.SetReadDeadline(proxy.ReadDeadline(*wsReadTimeout))
+		return nil
+	})
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- proxy.CatchPanic(s.tag+" mux session", s.readLoop) }()
+	go func() { errCh <- proxy.PingLoop(s.ctx, s.ws, &s.writeMu, *pingInterval, *pingJitter, s.tag) }()
+	err := <-errCh
+	s.close()
+	return err
+}
+
+func (s *muxSession) close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		proxy.CloseWS(s.ws, &s.writeMu, websocket.CloseNormalClosure, "", *closeTimeout, *skipCloseHandshake)
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = nil
+		s.mu.Unlock()
+		for _, st := range streams {
+			s.finish(st)
+		}
+	})
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	msg := make([]byte, muxFrameHeader+len(payload))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:5], id)
+	binary.BigEndian.PutUint32(msg[5:9], uint32(len(payload)))
+	copy(msg[muxFrameHeader:], payload)
+
+	s.writeMu.Lock()
+	_ = s.ws.SetWriteDeadline(time.Now().Add(proxy.TCPWriteTimeout))
+	err := s.ws.WriteMessage(websocket.BinaryMessage, msg)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.close()
+		return fmt.Errorf("%s WS write: %w", s.tag, err)
+	}
+	return nil
+}
+
+func (s *muxSession) readLoop() error {
+	for {
+		msgType, msg, err := s.ws.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("%s WS read: %w", s.tag, err)
+		}
+		_ = s.ws.SetReadDeadline(proxy.ReadDeadline(*wsReadTimeout))
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		for len(msg) > 0 {
+			if len(msg) < muxFrameHeader {
+				return errMuxFrame
+			}
+			typ := msg[0]
+			id := binary.BigEndian.Uint32(msg[1:5])
+			n := binary.BigEndian.Uint32(msg[5:9])
+			if uint64(n) > uint64(len(msg)-muxFrameHeader) {
+				return errMuxFrame
+			}
+			payload := msg[muxFrameHeader : muxFrameHeader+int(n)]
+			msg = msg[muxFrameHeader+int(n):]
+			if err := s.handleFrame(typ, id, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	switch typ {
+	case muxOpen:
+		if len(payload) != 0 {
+			return fmt.Errorf("%w: OPEN with payload", errMuxFrame)
+		}
+		if s.onOpen == nil {
+			// The exit connected a stream we opened.
+			if st := s.stream(id); st != nil {
+				return st.markOpened()
+			}
+			return nil
+		}
+		st := newMuxStream(id, nil, nil)
+		s.mu.Lock()
+		if s.streams == nil {
+			s.mu.Unlock()
+			return nil
+		}
+		_, dup := s.streams[id]
+		if !dup {
+			s.streams[id] = st
+		}
+		s.mu.Unlock()
+		if dup {
+			return fmt.Errorf("%w: stream %d opened twice", errMuxFrame, id)
+		}
+		go func() {
+			err := proxy.CatchPanic(fmt.Sprintf("%s mux stream %d", s.tag, id), func() error {
+				s.onOpen(st)
+				return nil
+			})
+			if err != nil {
+				s.closeStream(id, true)
+			}
+		}()
+	case muxData:
+		st := s.stream(id)
+		if st == nil {
+			// Closed on our side while the peer was still sending.
+			return nil
+		}
+		if err := globalLimiter.Wait(s.ctx, len(payload)); err != nil {
+			return err
+		}
+		if err := st.write(payload); err != nil {
+			if *debug && !errors.Is(err, errStreamClosed) {
+				log.Printf("%s mux stream %d TCP write: %v", s.tag, id, err)
+			}
+			s.closeStream(id, true)
+		}
+	case muxClose:
+		if len(payload) != 0 {
+			return fmt.Errorf("%w: CLOSE with payload", errMuxFrame)
+		}
+		s.closeStream(id, false)
+	default:
+		return fmt.Errorf("%w: type %d", errMuxFrame, typ)
+	}
+	return nil
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// openStream registers a new entry stream for conn.
+func (s *muxSession) openStream(conn net.Conn, info *connInfo) (*muxStream, error) {
+	s.mu.Lock()
+	if s.streams == nil {
+		s.mu.Unlock()
+		return nil, errStreamClosed
+	}
+	s.nextID++
+	st := newMuxStream(s.nextID, conn, info)
+	s.streams[st.id] = st
+	registerConn(info, func() { s.closeStream(st.id, true) })
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxOpen, st.id, nil); err != nil {
+		s.closeStream(st.id, false)
+		return nil, err
+	}
+	return st, nil
+}
+
+// closeStream forgets the stream and closes its TCP connection. With
+// notify the peer is told with a CLOSE frame.
+func (s *muxSession) closeStream(id uint32, notify bool) {
+	s.mu.Lock()
+	st := s.streams[id]
+	if st != nil {
+		delete(s.streams, id)
+	}
+	s.mu.Unlock()
+	if st == nil {
+		return
+	}
+	s.finish(st)
+	if notify {
+		_ = s.writeFrame(muxClose, id, nil)
+	}
+}
+
+func (s *muxSession) finish(st *muxStream) {
+	st.mu.Lock()
+	st.closed = true
+	close(st.done)
+	conn, info := st.conn, st.info
+	st.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	if info != nil {
+		unregisterConn(info)
+	}
+}
+
+// pump copies the stream's TCP data to the peer until the connection ends.
+func (s *muxSession) pump(st *muxStream) {
+	buf := make([]byte, min(*readBufferSize, int(*maxFramePayload)-muxFrameHeader))
+	for {
+		_ = st.conn.SetReadDeadline(proxy.ReadDeadline(*tcpReadTimeout))
+		n, err := st.conn.Read(buf)
+		if n > 0 {
+			if *dumpBytes {
+				proxy.DumpHex(fmt.Sprintf("%s conn %d TCP->WS (%d)", s.tag, st.info.ID, n), buf[:n], *dumpWidth)
+			}
+			if err := globalLimiter.Wait(s.ctx, n); err != nil {
+				return
+			}
+			if err := s.writeFrame(muxData, st.id, buf[:n]); err != nil {
+				return
+			}
+			st.info.ToWS.Add(int64(n))
+		}
+		if err != nil {
+			if *debug {
+				log.Printf("%s mux stream %d TCP read: %v", s.tag, st.id, err)
+			}
+			s.closeStream(st.id, true)
+			return
+		}
+		if n == 0 {
+			time.Sleep(proxy.ZeroReadBackoff)
+		}
+	}
+}
+
+///////////////////////
+//  入口机：维护持久的多路复用会话
+///////////////////////
+
+// muxClient keeps the entry's one session to the exit up, redialing with
+// exponential backoff.
+type muxClient struct {
+	mu    sync.Mutex
+	sess  *muxSession
+	ready chan struct{} // closed when sess is set
+}
+
+var entryMux = &muxClient{ready: make(chan struct{})}
+
+func (c *muxClient) run() {
+	header := backendHeader()
+	header.Set(muxHeader, "1")
+
+	backoff := muxBackoffMin
+	for {
+		ws, backendURL, err := dialBackendHeader(context.Background(), header, "")
+		if err == nil {
+			log.Println("[ENTRY] Mux session connected to", backendURL)
+			s := newMuxSession(context.Background(), ws, "[ENTRY]", nil)
+			s.backend = backendURL
+			c.mu.Lock()
+			c.sess = s
+			close(c.ready)
+			c.mu.Unlock()
+
+			start := time.Now()
+			err = s.run()
+
+			c.mu.Lock()
+			c.sess = nil
+			c.ready = make(chan struct{})
+			c.mu.Unlock()
+			if time.Since(start) >= muxStableSession {
+				log.Println("[ENTRY] Mux session closed, reconnecting:", err)
+				backoff = muxBackoffMin
+				continue
+			}
+		} else {
+			err = fmt.Errorf("dial WS backend %s: %w", dialErrKind(err), err)
+		}
+		log.Println("[ENTRY] Mux session:", err, "- retrying in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, muxBackoffMax)
+	}
+}
+
+// session returns the current session, waiting up to timeout for one to
+// come up.
+func (c *muxClient) session(timeout time.Duration) *muxSession {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		s, ready := c.sess, c.ready
+		c.mu.Unlock()
+		if s != nil {
+			return s
+		}
+		select {
+		case <-ready:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func handleMuxEntryConn(conn net.Conn) {
+	defer conn.Close()
+	if c, ok := proxy.InnerConn(conn).(*net.TCPConn); ok {
+		c.SetNoDelay(*tcpNoDelay)
+	}
+
+	s := entryMux.session(*entryDialTimeout)
+	if s == nil {
+		reject(rejectBackendDial, "[ENTRY]", "no mux session to the WS backend, closing", conn.RemoteAddr())
+		return
+	}
+	info := newConnInfo("entry", conn.RemoteAddr().String(), s.backend)
+	st, err := s.openStream(conn, info)
+	if err != nil {
+		log.Println("[ENTRY] Open mux stream:", err)
+		return
+	}
+	timer := time.NewTimer(*entryDialTimeout)
+	select {
+	case <-st.ready:
+		timer.Stop()
+	case <-st.done:
+		// CLOSE from the exit: the target could not be reached.
+		reject(rejectTargetDial, "[ENTRY]", "exit could not connect the target for", conn.RemoteAddr())
+		return
+	case <-timer.C:
+		log.Println("[ENTRY] Timed out waiting for the exit to connect the target for", conn.RemoteAddr())
+		s.closeStream(st.id, true)
+		return
+	}
+	s.pump(st)
+	logInfo("[ENTRY] Connection closed for player", conn.RemoteAddr())
+}
+
+///////////////////////
+//  出口机：为每个流连接目标
+///////////////////////
+
+func serveMuxExit(ctx context.Context, ws *websocket.Conn, remote, target string, local net.Addr) {
+	log.Println("[EXIT] New mux session from", remote)
+	var s *muxSession
+	s = newMuxSession(ctx, ws, "[EXIT]", func(st *muxStream) {
+		conn, err := dialTargetFor(target, remote, local)
+		if errors.Is(err, errTargetNotAllowed) {
+			reject(rejectTargetDenied, "[EXIT]", err)
+			s.closeStream(st.id, true)
+			return
+		}
+		if err != nil {
+			reject(rejectTargetDial, "[EXIT]", "dial TCP target", dialErrKind(err)+":", err)
+			s.closeStream(st.id, true)
+			return
+		}
+		info := newConnInfo("exit", remote, target)
+		if err := st.attach(conn, info, func() { s.closeStream(st.id, true) }); err != nil {
+			// CLOSE arrived while we were dialing.
+			_ = conn.Close()
+			return
+		}
+		if err := s.writeFrame(muxOpen, st.id, nil); err != nil {
+			return
+		}
+		s.pump(st)
+	})
+	err := s.run()
+	log.Println("[EXIT] Mux session closed from", remote+":", err)
+}
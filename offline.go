@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
+)
+
+var (
+	offlineMessage = flag.String("offline-message", "Server is starting, try again soon", "message shown to players when the backend is unreachable (needs -parse-handshake)")
+	statusMOTD     = flag.String("status-motd", "", "MOTD of the synthetic status shown while the backend is down (default -offline-message)")
+	statusVersion  = flag.String("status-version", "offline", "version text of the synthetic status shown while the backend is down")
+	statusFavicon  = flag.String("status-favicon", "", "64x64 PNG used as the favicon of the synthetic status")
+)
+
+// statusFaviconData is the data URI built from -status-favicon at startup.
+var statusFaviconData string
+
+func loadStatusFavicon() error {
+	if *statusFavicon == "" {
+		return nil
+	}
+	png, err := os.ReadFile(*statusFavicon)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(png, []byte("\x89PNG\r\n\x1a\n")) {
+		return fmt.Errorf("%s is not a PNG file", *statusFavicon)
+	}
+	statusFaviconData = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	return nil
+}
+
+// serveOffline answers a player whose backend could not be reached: login
+// attempts get a Disconnect with -offline-message, server list pings get a
+// synthetic status showing the server as offline. hello has already been
+// read from r.
+func serveOffline(r io.Reader, w io.Writer, hello *clientHello) {
+	switch hello.NextState {
+	case mcStateLogin, mcStateTransfer:
+		_ = writeLoginDisconnect(w, *offlineMessage)
+	case mcStateStatus:
+		if err := serveStatus(r, w, offlineStatus()); err != nil && *debug {
+			log.Println("offline status ping:", err)
+		}
+	}
+}
+
+// serveOfflineWS is serveOffline for the exit, where the player's bytes
+// arrive as binary frames relayed by the entry.
+func serveOfflineWS(ws *websocket.Conn) {
+	_ = ws.SetReadDeadline(time.Now().Add(handshakeReadTimeout))
+	_ = ws.SetWriteDeadline(time.Now().Add(handshakeReadTimeout))
+
+	r := &wsStreamReader{ws: ws}
+	hello, _, err := readClientHello(r)
+	if hello == nil {
+		if *debug {
+			log.Println("[EXIT] offline reply: no handshake:", err)
+		}
+		return
+	}
+	serveOffline(r, &wsStreamWriter{ws: ws}, hello)
+	_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(proxy.CloseWait))
+}
+
+type statusResponse struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int32  `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+	} `json:"players"`
+	Description struct {
+		Text string `json:"text"`
+	} `json:"description"`
+	Favicon string `json:"favicon,omitempty"`
+}
+
+func offlineStatus() []byte {
+	var st statusResponse
+	// Protocol -1 never matches, so the client shows the version name in red.
+	st.Version.Name = *statusVersion
+	st.Version.Protocol = -1
+	st.Description.Text = *offlineMessage
+	if *statusMOTD != "" {
+		st.Description.Text = *statusMOTD
+	}
+	st.Favicon = statusFaviconData
+	b, _ := json.Marshal(st)
+	return b
+}
+
+// serveStatus plays the server side of a status exchange after the
+// handshake: Status Request -> Status Response, then Ping -> Pong.
+func serveStatus(r io.Reader, w io.Writer, status []byte) error {
+	pr := &packetReader{r: r}
+	id, _, err := pr.readPacket(mcMaxHandshakePacket)
+	if err != nil {
+		return err
+	}
+	if id != 0x00 {
+		return nil
+	}
+	if err := writePacket(w, 0x00, appendString(nil, string(status))); err != nil {
+		return err
+	}
+
+	id, body, err := pr.readPacket(mcMaxHandshakePacket)
+	if err != nil {
+		// Some clients close right after reading the status.
+		return nil
+	}
+	if id != 0x01 || len(body) != 8 {
+		return nil
+	}
+	return writePacket(w, 0x01, body)
+}
+
+// wsStreamReader reads the payload of consecutive binary frames as a stream.
+type wsStreamReader struct {
+	ws  *websocket.Conn
+	buf []byte
+}
+
+func (r *wsStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msgType, data, err := r.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if msgType == websocket.BinaryMessage {
+			r.buf = data
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// wsStreamWriter sends each Write as one binary frame.
+type wsStreamWriter struct {
+	ws *websocket.Conn
+}
+
+func (w *wsStreamWriter) Write(p []byte) (int, error) {
+	if err := w.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
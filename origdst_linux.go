@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+const originalDstSupported = true
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST, which x/sys does not define;
+// it has the same value as SO_ORIGINAL_DST.
+const ip6tSoOriginalDst = 80
+
+// originalDst asks conntrack where a connection redirected by iptables
+// REDIRECT or DNAT was headed. An IPv4 player is looked up at SOL_IP even
+// on a dual-stack listener.
+func originalDst(c *net.TCPConn) (netip.AddrPort, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	v4 := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+	var dst netip.AddrPort
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if v4 {
+			// sockaddr_in fits in the 20 bytes of an IPv6Mreq: family,
+			// port (big endian), address.
+			var m *unix.IPv6Mreq
+			if m, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); serr == nil {
+				raw := m.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(raw[4:8])), binary.BigEndian.Uint16(raw[2:4]))
+			}
+			return
+		}
+		// sockaddr_in6 is the first field of an IPv6MTUInfo.
+		var info *unix.IPv6MTUInfo
+		if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); serr == nil {
+			// The port is in network byte order in memory.
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, serr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// SO_ORIGINAL_DST is Linux only; -transparent is refused elsewhere.
+const originalDstSupported = false
+
+func originalDst(c *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.ErrUnsupported
+}
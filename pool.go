@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"mc-ws-proxy/proxy"
+)
+
+var wsPoolSize = flag.Int("ws-pool-size", 0, "on the entry, keep this many WebSocket connections to the backend dialed in advance and hand one to each new player (0 = dial when the player connects; not with -proxy-hello or -mux)")
+
+///////////////////////
+//  入口机：预先建立的 WebSocket 连接池
+///////////////////////
+
+const (
+	poolBackoffMin = 500 * time.Millisecond
+	poolBackoffMax = 30 * time.Second
+
+	// poolIdleDataLimit caps what an idle pooled connection may receive
+	// (pongs, TLS session tickets, a server that speaks first) before it
+	// is thrown away instead of buffered further.
+	poolIdleDataLimit = 64 << 10
+)
+
+var errPoolIdleData = errors.New("backend sent too much data while the connection was pooled")
+
+// wsPool keeps -ws-pool-size idle connections to the backends. Each one
+// pings on its own and has a goroutine watching the socket, so one the
+// backend closed while it sat in the pool is dropped and replaced right
+// away rather than handed to a player.
+type wsPool struct {
+	mu   sync.Mutex
+	idle []*pooledWS
+	wake chan struct{} // nudges run to top the pool up
+
+	misses atomic.Int64 // players who found the pool empty and dialed themselves
+}
+
+var entryPool = &wsPool{wake: make(chan struct{}, 1)}
+
+type pooledWS struct {
+	ws  *websocket.Conn
+	url string
+	raw *watchConn
+
+	cancel     context.CancelFunc // stops the ping loop
+	pingDone   chan struct{}
+	watchDone  chan struct{}
+	watchErr   error // set before watchDone is closed
+	checkedOut atomic.Bool
+}
+
+func (p *wsPool) nudge() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *wsPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// run dials until the pool is full, then waits for a connection to be
+// taken or to die. Failed dials back off exponentially.
+func (p *wsPool) run() {
+	backoff := poolBackoffMin
+	for {
+		for p.size() < *wsPoolSize {
+			pc, err := p.dial()
+			if err != nil {
+				log.Println("[ENTRY] WS pool: dial WS backend", dialErrKind(err)+":", err, "- retrying in", backoff)
+				time.Sleep(backoff)
+				backoff = min(backoff*2, poolBackoffMax)
+				continue
+			}
+			backoff = poolBackoffMin
+			p.mu.Lock()
+			p.idle = append(p.idle, pc)
+			p.mu.Unlock()
+			if *debug {
+				log.Println("[ENTRY] WS pool: connected to", pc.url)
+			}
+		}
+		<-p.wake
+	}
+}
+
+func (p *wsPool) dial() (*pooledWS, error) {
+	b, err := pickBackend()
+	if err != nil {
+		return nil, err
+	}
+	var raw *watchConn
+	ws, err := dialURLWrap(context.Background(), b.URL, backendHeader(), func(c net.Conn) net.Conn {
+		raw = &watchConn{Conn: c}
+		return raw
+	})
+	b.report(err)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &pooledWS{ws: ws, url: b.URL, raw: raw, cancel: cancel, pingDone: make(chan struct{}), watchDone: make(chan struct{})}
+	go func() {
+		defer close(pc.pingDone)
+		var mu sync.Mutex
+		if err := proxy.PingLoop(ctx, ws, &mu, *pingInterval, *pingJitter, "[ENTRY] WS pool"); err != nil {
+			p.evict(pc, err)
+		}
+	}()
+	go func() {
+		err := raw.watch(poolIdleDataLimit)
+		pc.watchErr = err
+		close(pc.watchDone)
+		if !pc.checkedOut.Load() {
+			p.evict(pc, err)
+		}
+	}()
+	return pc, nil
+}
+
+// evict drops pc from the pool after its ping or watch failed.
+func (p *wsPool) evict(pc *pooledWS, err error) {
+	p.mu.Lock()
+	found := false
+	for i, c := range p.idle {
+		if c == pc {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			found = true
+			break
+		}
+	}
+	p.mu.Unlock()
+	if !found {
+		return
+	}
+	if *debug {
+		log.Println("[ENTRY] WS pool: dropping idle connection to", pc.url+":", err)
+	}
+	pc.cancel()
+	_ = pc.ws.Close()
+	p.nudge()
+}
+
+// evictBackend drops the idle connections to url, which is being drained.
+func (p *wsPool) evictBackend(url string) {
+	p.mu.Lock()
+	var drop []*pooledWS
+	for _, pc := range p.idle {
+		if pc.url == url {
+			drop = append(drop, pc)
+		}
+	}
+	p.mu.Unlock()
+	for _, pc := range drop {
+		p.evict(pc, errors.New("backend is draining"))
+	}
+}
+
+// get takes the newest idle connection, stops its ping and watch
+// goroutines and checks it did not die in the meantime. It returns nil when
+// the pool has nothing usable and the caller should dial itself.
+func (p *wsPool) get() (*websocket.Conn, string) {
+	defer p.nudge()
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			p.misses.Add(1)
+			return nil, ""
+		}
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if backendDraining(pc.url) {
+			pc.cancel()
+			_ = pc.ws.Close()
+			continue
+		}
+		if err := pc.checkout(); err != nil {
+			if *debug {
+				log.Println("[ENTRY] WS pool: idle connection to", pc.url, "was dead:", err)
+			}
+			_ = pc.ws.Close()
+			continue
+		}
+		return pc.ws, pc.url
+	}
+}
+
+// checkout ends the pooled life of pc. The watcher is stopped by expiring
+// the socket's read deadline; a timeout is therefore the expected result,
+// anything else means the connection broke while idle.
+func (pc *pooledWS) checkout() error {
+	pc.checkedOut.Store(true)
+	pc.cancel()
+	<-pc.pingDone
+	_ = pc.raw.Conn.SetReadDeadline(time.Now())
+	<-pc.watchDone
+	_ = pc.raw.Conn.SetReadDeadline(time.Time{})
+
+	var ne net.Error
+	if errors.As(pc.watchErr, &ne) && ne.Timeout() {
+		return nil
+	}
+	return pc.watchErr
+}
+
+// watchConn is the TCP connection under a pooled WebSocket. While pooled,
+// watch reads from the socket so a close by the backend is noticed; what it
+// reads is kept and handed out first once the WebSocket starts reading.
+type watchConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (c *watchConn) watch(limit int) error {
+	buf := make([]byte, 512)
+	for {
+		n, err := c.Conn.Read(buf)
+		c.mu.Lock()
+		c.pending = append(c.pending, buf[:n]...)
+		over := len(c.pending) > limit
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if over {
+			return errPoolIdleData
+		}
+	}
+}
+
+func (c *watchConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
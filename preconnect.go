@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"time"
+)
+
+var preconnectBuffer = flag.Int("preconnect-buffer", 0, "on the entry, start reading the player's bytes while the WebSocket is still being dialed, keeping up to this many and replaying them once it is up; a player that sends more is dropped (0 = off; -parse-handshake reads the handshake before dialing anyway)")
+
+var errPreconnectFull = errors.New("player sent more than -preconnect-buffer before the backend was up")
+
+// preconnect reads from a player connection in the background while the
+// entry dials the backend, so the client's first bytes are taken off the
+// socket right away instead of waiting for the dial.
+type preconnect struct {
+	conn  net.Conn
+	limit int
+	buf   []byte
+	err   error
+	gone  func() // called if the player disconnects; nil = not watched
+	done  chan struct{}
+}
+
+func startPreconnect(c net.Conn, limit int, gone func()) *preconnect {
+	p := &preconnect{conn: c, limit: limit, gone: gone, done: make(chan struct{})}
+	go p.read()
+	return p
+}
+
+func (p *preconnect) read() {
+	defer close(p.done)
+	chunk := make([]byte, min(p.limit+1, 4096))
+	for {
+		n, err := p.conn.Read(chunk)
+		p.buf = append(p.buf, chunk[:n]...)
+		if len(p.buf) > p.limit {
+			p.err = errPreconnectFull
+			_ = p.conn.Close()
+			return
+		}
+		if err != nil {
+			// EOF and read errors show up again on the bridge's next read,
+			// unless the dial is given up for them.
+			if p.gone != nil && playerLeft(err) {
+				p.gone()
+			}
+			return
+		}
+	}
+}
+
+// stop interrupts the reader and returns the bytes it collected, or
+// errPreconnectFull if the player overran the buffer (the connection is
+// closed by then).
+func (p *preconnect) stop() ([]byte, error) {
+	_ = p.conn.SetReadDeadline(time.Now())
+	<-p.done
+	_ = p.conn.SetReadDeadline(time.Time{})
+	return p.buf, p.err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+var countAfterHandshake = flag.Bool("count-after-handshake", false, "on the entry, treat a connection as a player only once it has sent a valid Minecraft handshake; ones that close or send anything else first are probes (port scanners), closed without dialing, counted apart and logged only with -debug (turns on handshake parsing)")
+
+///////////////////////
+//  入口机：区分扫描探测与真实玩家
+///////////////////////
+
+// probeConns counts connections closed by -count-after-handshake.
+var probeConns atomic.Uint64
+
+func logNewPlayer(c net.Conn) {
+	if *transparent {
+		logInfo("[ENTRY] New player from", c.RemoteAddr(), "to", c.LocalAddr())
+	} else {
+		logInfo("[ENTRY] New player from", c.RemoteAddr())
+	}
+}
+
+// countProbe records a connection that ended or failed before its
+// handshake was read.
+func countProbe(c net.Conn, err error) {
+	probeConns.Add(1)
+	if *debug {
+		log.Println("[ENTRY] Probe from", c.RemoteAddr(), "closed without a handshake:", err)
+	}
+}
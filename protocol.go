@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+var (
+	minProtocol         = flag.Int("min-protocol", 0, "lowest Minecraft protocol version allowed to log in (0 = no limit; implies -parse-handshake)")
+	maxProtocol         = flag.Int("max-protocol", 0, "highest Minecraft protocol version allowed to log in (0 = no limit; implies -parse-handshake)")
+	protocolRejectText  = flag.String("protocol-reject-message", "Please use a supported Minecraft version", "disconnect message shown to players whose protocol version is outside -min-protocol/-max-protocol")
+	protocolStatusReply = flag.Bool("protocol-status-reply", false, "answer server list pings from clients outside the protocol range with a synthetic status showing -protocol-reject-message, instead of passing them through")
+)
+
+func protocolFilterEnabled() bool {
+	return *minProtocol != 0 || *maxProtocol != 0
+}
+
+func checkProtocolRange() error {
+	if *minProtocol < 0 || *maxProtocol < 0 {
+		return fmt.Errorf("-min-protocol and -max-protocol must not be negative")
+	}
+	if *minProtocol != 0 && *maxProtocol != 0 && *minProtocol > *maxProtocol {
+		return fmt.Errorf("-min-protocol %d is above -max-protocol %d", *minProtocol, *maxProtocol)
+	}
+	return nil
+}
+
+// protocolAllowed reports whether a client speaking protocol version v may
+// log in. Real clients never send a negative version to log in, so those
+// (and anything a malformed varint decoded to) are refused once a limit is
+// set.
+func protocolAllowed(v int32) bool {
+	if v < 0 {
+		return false
+	}
+	if *minProtocol != 0 && int64(v) < int64(*minProtocol) {
+		return false
+	}
+	if *maxProtocol != 0 && int64(v) > int64(*maxProtocol) {
+		return false
+	}
+	return true
+}
+
+// protocolRejectStatus is the synthetic status for -protocol-status-reply.
+// Protocol -1 never matches, so the client marks the server incompatible.
+func protocolRejectStatus() []byte {
+	var st statusResponse
+	st.Version.Name = *protocolRejectText
+	st.Version.Protocol = -1
+	st.Description.Text = *protocolRejectText
+	st.Favicon = statusFaviconData
+	b, _ := json.Marshal(st)
+	return b
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import "syscall"
+
+const corkSupported = true
+
+// corkQueueSize is how many WS frames CorkWrites reads ahead.
+const corkQueueSize = 64
+
+// setCork turns TCP_CORK on or off. Turning it off flushes whatever the
+// kernel held back.
+func setCork(c syscall.Conn, on bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
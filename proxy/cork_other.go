@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// TCP_CORK is Linux only; CorkWrites is ignored elsewhere.
+const corkSupported = false
+
+const corkQueueSize = 0
+
+func setCork(c syscall.Conn, on bool) error { return nil }
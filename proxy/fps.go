@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errFrameRate ends a bridge under MaxFPS with FPSClose whose peer sent
+// frames faster than allowed.
+var errFrameRate = errors.New("frame rate over -max-fps")
+
+// frameLimiter caps one direction of a bridge at limit frames per second,
+// using a sliding window counter: the count of the previous one-second
+// window, weighted by how much of it still overlaps the last second, plus
+// the count of the current window. It needs no per-frame history and is
+// only used by the goroutine copying that direction.
+type frameLimiter struct {
+	limit     int
+	start     int64 // monoNow when the current window began
+	cur, prev int
+}
+
+func newFrameLimiter(limit int) *frameLimiter {
+	return &frameLimiter{limit: limit, start: monoNow()}
+}
+
+// take records one frame at now if the rate allows it. Otherwise it
+// returns how long to wait before asking again.
+func (l *frameLimiter) take(now int64) time.Duration {
+	const window = int64(time.Second)
+	if elapsed := now - l.start; elapsed >= window {
+		if elapsed >= 2*window {
+			l.prev = 0
+		} else {
+			l.prev = l.cur
+		}
+		l.cur = 0
+		l.start = now - elapsed%window
+	}
+	overlap := window - (now - l.start)
+	if int64(l.prev)*overlap/window+int64(l.cur) < int64(l.limit) {
+		l.cur++
+		return 0
+	}
+	return time.Second / time.Duration(l.limit)
+}
+
+// limitFrames applies MaxFPS to a frame about to be forwarded from side:
+// with FPSClose it fails the bridge, otherwise it waits until the frame
+// fits the rate. A nil l means no limit.
+func (b *bridge) limitFrames(ctx context.Context, l *frameLimiter, side string) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		wait := l.take(monoNow())
+		if wait == 0 {
+			return nil
+		}
+		if b.cfg.FPSClose {
+			return fmt.Errorf("%s %s %w (%d)", b.cfg.Tag, side, errFrameRate, l.limit)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
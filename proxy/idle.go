@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The idle timeouts (TCPReadTimeout, WSReadTimeout) are not socket
+// deadlines: a deadline that expired while the process was paused (VM
+// pause/resume, host suspend, SIGSTOP) fires the moment it resumes, and a
+// timed-out read ends a gorilla WebSocket for good. Instead each bridge
+// records when it last heard from either side and checks that from a
+// ticker. A tick that arrives much later than scheduled means the process
+// was not running, so the bridge starts the idle clocks over rather than
+// closing the connection.
+
+// clockSlack is how much later than scheduled an idle check may run before
+// the bridge assumes the process was paused rather than merely busy.
+const clockSlack = 3 * time.Second
+
+var clockBase = time.Now()
+
+// monoNow is the monotonic time in nanoseconds since clockBase.
+func monoNow() int64 { return int64(time.Since(clockBase)) }
+
+// idleTimeoutError is what an idle side reports; it is a net.Error with
+// Timeout() true, so it maps to the "idle-timeout" close reason.
+type idleTimeoutError struct{ side string }
+
+func (e *idleTimeoutError) Error() string   { return e.side + " idle timeout" }
+func (e *idleTimeoutError) Timeout() bool   { return true }
+func (e *idleTimeoutError) Temporary() bool { return true }
+
+// idleState is the part of a bridge the idle check works on.
+type idleState struct {
+	lastTCP, lastWS atomic.Int64 // monoNow of the last data (or pong/ping, for WS)
+	tcpDone, wsDone atomic.Bool  // that side half-closed; stop timing it
+}
+
+func (s *idleState) touchTCP() { s.lastTCP.Store(monoNow()) }
+func (s *idleState) touchWS()  { s.lastWS.Store(monoNow()) }
+
+// idleTick is how often idleLoop checks, a fraction of the shortest
+// timeout so a connection is closed close to on time.
+func idleTick(tcpTimeout, wsTimeout time.Duration) time.Duration {
+	shortest := tcpTimeout
+	if shortest <= 0 || (wsTimeout > 0 && wsTimeout < shortest) {
+		shortest = wsTimeout
+	}
+	return min(max(shortest/8, 50*time.Millisecond), time.Second)
+}
+
+// idleLoop ends the bridge once a side has been silent for longer than its
+// timeout.
+func (b *bridge) idleLoop(ctx context.Context) error {
+	cfg := b.cfg
+	tick := idleTick(cfg.TCPReadTimeout, cfg.WSReadTimeout)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	last := monoNow()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		now := monoNow()
+		if gap := time.Duration(now - last); gap > tick+clockSlack {
+			if cfg.Debug {
+				log.Printf("%s idle check ran %v late, restarting idle timeouts", cfg.Tag, (gap - tick).Round(time.Millisecond))
+			}
+			b.idle.lastTCP.Store(now)
+			b.idle.lastWS.Store(now)
+		}
+		last = now
+
+		if cfg.TCPReadTimeout > 0 && !b.idle.tcpDone.Load() && time.Duration(now-b.idle.lastTCP.Load()) > cfg.TCPReadTimeout {
+			return fmt.Errorf("%s %w: %w", cfg.Tag, errTCPRead, &idleTimeoutError{"TCP"})
+		}
+		if cfg.WSReadTimeout > 0 && !b.idle.wsDone.Load() && time.Duration(now-b.idle.lastWS.Load()) > cfg.WSReadTimeout {
+			return fmt.Errorf("%s WS read: %w", cfg.Tag, &idleTimeoutError{"WS"})
+		}
+	}
+}
+
+var clockWatchOnce sync.Once
+
+// watchClock logs, once per event, when the process was paused or the wall
+// clock was stepped (NTP, manual change). Deadlines and the idle checks run
+// on the monotonic clock, so a wall clock step alone is harmless; the log
+// line is there to explain what happened around it.
+func watchClock() {
+	clockWatchOnce.Do(func() {
+		go func() {
+			const every = time.Second
+			prev := time.Now()
+			for range time.Tick(every) {
+				now := time.Now()
+				mono := now.Sub(prev)
+				wall := now.Round(0).Sub(prev.Round(0))
+				if mono > every+clockSlack {
+					log.Printf("[CLOCK] process was paused for about %v (VM pause/resume?); idle timeouts restarted", (mono - every).Round(time.Second))
+				} else if d := wall - mono; d > clockSlack || d < -clockSlack {
+					log.Printf("[CLOCK] wall clock stepped by %v; connection timeouts are unaffected", d.Round(time.Second))
+				}
+				prev = now
+			}
+		}()
+	})
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrMemoryLimit ends a bridge whose peer sent a WebSocket message larger
+// than what MaxConnMemory leaves for one.
+var ErrMemoryLimit = errors.New("message exceeds -max-conn-memory")
+
+// memBudget bounds the bytes one direction of a bridge holds in buffers.
+// MaxConnMemory, less the read buffers the bridge allocates up front, is
+// split in two: one half for frames waiting in the write queue (TCP->WS),
+// the other for WebSocket messages read but not yet written to TCP. Each
+// half has its own budget, so a direction that is stuck waiting for its
+// peer never holds up the other one. Whoever wants more than is left waits
+// in acquire until the consumer of that direction gives some back.
+type memBudget struct {
+	limit int64
+
+	mu    sync.Mutex
+	used  int64
+	freed chan struct{} // closed and replaced on every release
+}
+
+// memBudgets returns the TCP->WS and WS->TCP budgets for cfg and the
+// largest WS message the second one can hold, or nils and
+// cfg.MaxFramePayload when cfg.MaxConnMemory is 0.
+func memBudgets(cfg *Config) (out, in *memBudget, readLimit int64) {
+	if cfg.MaxConnMemory <= 0 {
+		return nil, nil, cfg.MaxFramePayload
+	}
+	half := (cfg.MaxConnMemory - readBuffersSize(cfg)) / 2
+	readLimit = cfg.MaxFramePayload
+	if half < readLimit {
+		readLimit = half
+	}
+	return newMemBudget(half), newMemBudget(half), readLimit
+}
+
+func newMemBudget(limit int64) *memBudget {
+	return &memBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// readBuffersSize is what a bridge allocates for reading no matter what:
+// the TCP read buffer, and with StreamFrames the WS streaming buffer.
+func readBuffersSize(cfg *Config) int64 {
+	n := int64(cfg.ReadBufferSize)
+	if cfg.StreamFrames {
+		n *= 2
+	}
+	return n
+}
+
+// MinConnMemory is the smallest MaxConnMemory for cfg: the read buffers
+// plus room for one full frame in each direction.
+func MinConnMemory(cfg *Config) int64 {
+	frame := int64(cfg.ReadBufferSize)
+	if cfg.MaxFramePayload < frame {
+		frame = cfg.MaxFramePayload
+	}
+	return readBuffersSize(cfg) + 2*frame
+}
+
+// acquire waits until n more bytes fit in the budget. A request is always
+// let through when nothing is held, so one that is larger than the whole
+// budget cannot wait forever. A nil m never waits.
+func (m *memBudget) acquire(ctx context.Context, n int64) error {
+	if m == nil {
+		return nil
+	}
+	for {
+		m.mu.Lock()
+		if m.used+n <= m.limit || m.used == 0 {
+			m.used += n
+			m.mu.Unlock()
+			return nil
+		}
+		freed := m.freed
+		m.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *memBudget) release(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mu.Lock()
+	m.used -= n
+	close(m.freed)
+	m.freed = make(chan struct{})
+	m.mu.Unlock()
+}
+
+// wsReadErr wraps an error from a WS read. Hitting a read limit that
+// MaxConnMemory lowered below MaxFramePayload is reported as ErrMemoryLimit.
+func (b *bridge) wsReadErr(err error) error {
+	if b.readLimit < b.cfg.MaxFramePayload && errors.Is(err, websocket.ErrReadLimit) {
+		return fmt.Errorf("%s WS read: %w (%d bytes): %w", b.cfg.Tag, ErrMemoryLimit, b.readLimit, err)
+	}
+	return fmt.Errorf("%s WS read: %w", b.cfg.Tag, err)
+}
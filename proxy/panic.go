@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// ErrPanic is wrapped by the error Bridge returns when one of its
+// goroutines panicked. The panic is logged and the connection is torn down
+// like any other failure; the rest of the process carries on.
+var ErrPanic = errors.New("panic")
+
+// LogPanic logs a value returned by recover together with the stack of the
+// goroutine that panicked. Call it from the deferred function that
+// recovered.
+func LogPanic(tag string, p any) {
+	log.Printf("%s PANIC: %v\n%s", tag, p, debug.Stack())
+}
+
+// CatchPanic runs fn and returns its error. If fn panics, the panic is
+// logged with LogPanic and returned as an error wrapping ErrPanic.
+func CatchPanic(tag string, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			LogPanic(tag, p)
+			err = fmt.Errorf("%w: %v", ErrPanic, p)
+		}
+	}()
+	return fn()
+}
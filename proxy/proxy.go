@@ -0,0 +1,1124 @@
+// Package proxy copies data between a player's TCP connection and the
+// WebSocket tunnel. It holds no global state: everything a bridge needs
+// comes in through Config, so it can be driven by the mc-ws-proxy binary
+// or by tests with in-memory connections.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// TCPWriteTimeout bounds every single write, on either side.
+	TCPWriteTimeout = 30 * time.Second
+	// CloseWait is how long a close frame may take to go out.
+	CloseWait = 2 * time.Second
+	// ZeroReadBackoff is the pause after a (0, nil) read.
+	ZeroReadBackoff = 10 * time.Millisecond
+)
+
+// Config is the per-bridge configuration.
+type Config struct {
+	Tag string // log prefix, e.g. "[ENTRY]"
+
+	MaxFramePayload int64         // WS read limit and largest frame sent; must be > 0
+	ReadBufferSize  int           // TCP read buffer size; must be > 0
+	WriteQueueSize  int           // frames queued before the WS writer; 0 = write synchronously
+	CoalesceDelay   time.Duration // merge TCP reads arriving within this window; 0 = off
+	MaxTCPWrite     int           // close with 1009 on larger binary frames; 0 = no cap
+	HalfClose       bool          // forward TCP half-closes as empty binary frames
+	CorkWrites      bool          // batch back-to-back frames with TCP_CORK (Linux only)
+	StrictFrames    bool          // close with 1002 on frame types the bridge does not handle (and text frames under TextError)
+	StreamFrames    bool          // copy binary messages to TCP as they arrive instead of reading each whole; no WS read limit for them
+	RateLimit       *RateLimiter  // shared across bridges, both directions; nil = unlimited
+	MaxFPS          int           // frames per second allowed in each direction, counted per TCP read and per WS message; 0 = unlimited
+	FPSClose        bool          // over MaxFPS, close with 1008 instead of slowing the reads down
+	MaxConnMemory   int64         // bytes buffered by the bridge, read buffers included (see memBudget); at least MinConnMemory, 0 = unlimited
+	Reassembly      *Reassembly   // shared across bridges, counts WS messages held whole; nil = untracked
+
+	TCPReadTimeout time.Duration // close after this long without data; 0 = never
+	TCPWriteIdle   bool          // successful TCP writes also restart TCPReadTimeout
+	WSReadTimeout  time.Duration // same for the WebSocket, pongs count; 0 = never
+	PingInterval   time.Duration // must be > 0
+	PingJitter     float64       // randomize each ping wait by this fraction of PingInterval, 0 <= x < 1
+	MaxLifetime    time.Duration // 0 = unlimited
+
+	CloseTimeout       time.Duration // limit on sending the close frame; 0 = CloseWait
+	SkipCloseHandshake bool          // close the socket without a close frame
+
+	// TCPHandshakeTimeout and WSHandshakeTimeout end a bridge whose TCP
+	// side (any byte) or WS side (a binary frame) has sent nothing this
+	// long after the bridge started. Pong frames do not count. 0 = off.
+	TCPHandshakeTimeout time.Duration
+	WSHandshakeTimeout  time.Duration
+
+	Debug     bool
+	DumpBytes bool
+	DumpWidth int    // bytes per DumpHex line; 0 = DefaultDumpWidth
+	ConnID    uint64 // shown in dumps
+
+	// Capture, if set, is called synchronously with every chunk read from
+	// TCP (toTCP false) and every payload about to be written to TCP (toTCP
+	// true). It must not keep data.
+	Capture func(toTCP bool, data []byte)
+
+	// Stats, if set, is called every StatsInterval and the result sent as
+	// a text frame.
+	Stats         func() []byte
+	StatsInterval time.Duration
+	// OnText receives incoming text frames. When set, TextFrames is not
+	// consulted.
+	OnText func(data []byte)
+	// TextFrames says what to do with text frames otherwise.
+	TextFrames TextPolicy
+
+	// Counters, if set, is updated as data is forwarded.
+	Counters *Counters
+
+	// OnRTT, if set, makes every ping carry a timestamp that the peer
+	// echoes back in its pong; it is called with the round trip of each.
+	OnRTT func(rtt time.Duration)
+}
+
+// TextPolicy is how a bridge handles text frames nobody listens for.
+type TextPolicy int
+
+const (
+	TextIgnore  TextPolicy = iota // drop them, as in wsmc
+	TextLog                       // drop them and log their size
+	TextError                     // close the bridge with code 1003
+	TextForward                   // write the payload to TCP like a binary frame
+)
+
+// Counters are the bytes a bridge forwarded in each direction.
+type Counters struct {
+	ToWS  atomic.Int64 // TCP -> WS
+	ToTCP atomic.Int64 // WS -> TCP
+}
+
+// FirstWriteError reports that the first TCP->WS write failed before any
+// byte was forwarded in either direction, typically because the CDN closed
+// an idle upstream right after the upgrade. Data is what was read from TCP
+// and still has to be sent.
+type FirstWriteError struct {
+	Data []byte
+	Err  error
+}
+
+func (e *FirstWriteError) Error() string { return e.Err.Error() }
+func (e *FirstWriteError) Unwrap() error { return e.Err }
+
+// CloseWriter is implemented by *net.TCPConn and *net.UnixConn.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// InnerConn follows NetConn methods, like the one on *tls.Conn, down from c
+// to the connection that owns the socket.
+func InnerConn(c net.Conn) net.Conn {
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = w.NetConn()
+	}
+}
+
+// errHalfClosed is returned by a copy direction that finished cleanly in
+// half-close mode; the bridge keeps running until both directions finish.
+var errHalfClosed = errors.New("half-closed")
+
+// errMaxLifetime ends a bridge that has been open for MaxLifetime.
+var errMaxLifetime = errors.New("max connection lifetime reached")
+
+// errTCPWriteTooBig ends a bridge whose peer sent a binary frame larger
+// than MaxTCPWrite.
+var errTCPWriteTooBig = errors.New("frame exceeds -max-tcp-write")
+
+// errHandshakeTimeout ends a bridge whose peer never sent its first data
+// within TCPHandshakeTimeout or WSHandshakeTimeout.
+var errHandshakeTimeout = errors.New("handshake-timeout")
+
+// errTCPRead and errTCPWrite mark errors from the TCP side, so the close
+// reason can tell them from WebSocket failures.
+var (
+	errTCPRead  = errors.New("TCP read")
+	errTCPWrite = errors.New("TCP write")
+)
+
+// errTextFrame ends a bridge that got a text frame under TextError.
+var errTextFrame = errors.New("unexpected text frame")
+
+// errUnexpectedFrame ends a bridge under StrictFrames that got a frame type
+// it has no use for.
+var errUnexpectedFrame = errors.New("unexpected frame type")
+
+// ReadDeadline returns the read deadline for a timeout. A zero timeout
+// yields the zero time, which clears any deadline still set (for example
+// the short one used while coalescing reads).
+func ReadDeadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// Bridge copies data both ways until either side fails or ctx is done, and
+// then closes both connections. It returns the error that ended the bridge,
+// nil if both directions half-closed cleanly. The exception is a
+// *FirstWriteError, returned when the very first WS write failed before
+// anything was forwarded: in that case tcpConn is left open so the caller
+// can retry over a new WebSocket.
+//
+// The close frame sent to the peer carries a short reason such as
+// "tcp-eof" or "idle-timeout". When ctx is canceled with a cause (see
+// context.WithCancelCause), the cause's text is the reason.
+func Bridge(ctx context.Context, tcpConn net.Conn, ws *websocket.Conn, cfg Config) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if cfg.Counters == nil {
+		cfg.Counters = new(Counters)
+	}
+	b := &bridge{cfg: &cfg, tcp: tcpConn, ws: ws}
+	if cfg.MaxFPS > 0 {
+		b.tcpFrames, b.wsFrames = newFrameLimiter(cfg.MaxFPS), newFrameLimiter(cfg.MaxFPS)
+	}
+	var memOut *memBudget
+	memOut, b.memIn, b.readLimit = memBudgets(&cfg)
+	if cfg.Reassembly != nil {
+		b.reasm = &bridgeReassembly{shared: cfg.Reassembly}
+	}
+
+	if !cfg.StreamFrames {
+		ws.SetReadLimit(b.readLimit)
+	}
+	b.idle.touchTCP()
+	b.idle.touchWS()
+	ws.SetPongHandler(func(appData string) error {
+		b.idle.touchWS()
+		if cfg.OnRTT != nil {
+			if rtt, ok := parseRTTBeacon(appData); ok {
+				cfg.OnRTT(rtt)
+			}
+		}
+		return nil
+	})
+
+	errCh := make(chan taskResult, 9) // room for one result from each goroutine started below
+	var wg sync.WaitGroup
+	b.out = newWSWriter(ws, &b.wsWriteMu, cfg.Tag, cfg.WriteQueueSize)
+	b.out.mem = memOut
+
+	// Pings and pongs normally take the write lock like data frames. With a
+	// write queue they skip it: gorilla allows WriteControl alongside the
+	// one data writer, so a control frame then waits at most for the frame
+	// already on the wire, within its own deadline, instead of for a slow
+	// WriteMessage and the queue behind it.
+	controlMu := &b.wsWriteMu
+	if b.out.queue != nil {
+		controlMu = nil
+	}
+
+	// Replace gorilla's default ping handler so our pongs follow the rule
+	// above and pings count as read activity.
+	ws.SetPingHandler(func(appData string) error {
+		if cfg.Debug {
+			log.Printf("%s WS ping received (%d bytes)", cfg.Tag, len(appData))
+		}
+		b.idle.touchWS()
+		if controlMu != nil {
+			controlMu.Lock()
+		}
+		err := ws.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(TCPWriteTimeout))
+		if controlMu != nil {
+			controlMu.Unlock()
+		}
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if _, ok := err.(net.Error); ok {
+			// Timeouts are reported by the data path.
+			return nil
+		}
+		return err
+	})
+
+	// A panic in any of these is logged and ends the bridge like an
+	// error instead of taking the process down.
+	panicTag := fmt.Sprintf("%s conn %d", cfg.Tag, cfg.ConnID)
+	run := func(name string, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- taskResult{name, CatchPanic(panicTag, fn)}
+		}()
+	}
+
+	if b.out.queue != nil {
+		run("write queue", func() error { return b.out.run(ctx) })
+	}
+	run("TCP->WS", func() error { return b.copyTCPToWS(ctx) })
+	run("WS->TCP", func() error { return b.copyWSToTCP(ctx) })
+	var payload func() []byte
+	if cfg.OnRTT != nil {
+		payload = rttBeacon
+	}
+	run("ping", func() error {
+		return pingLoop(ctx, ws, controlMu, cfg.PingInterval, cfg.PingJitter, cfg.Tag, payload)
+	})
+	if cfg.TCPReadTimeout > 0 || cfg.WSReadTimeout > 0 {
+		watchClock()
+		run("idle timer", func() error { return b.idleLoop(ctx) })
+	}
+	if cfg.Stats != nil {
+		run("stats", func() error { return b.statsLoop(ctx) })
+	}
+	if cfg.TCPHandshakeTimeout > 0 {
+		run("TCP handshake timer", func() error { return handshakeTimer(ctx, &b.gotTCP, cfg.TCPHandshakeTimeout, "TCP") })
+	}
+	if cfg.WSHandshakeTimeout > 0 {
+		run("WS handshake timer", func() error { return handshakeTimer(ctx, &b.gotWS, cfg.WSHandshakeTimeout, "WS") })
+	}
+	if cfg.MaxLifetime > 0 {
+		run("lifetime timer", func() error { return lifetimeTimer(ctx, cfg.MaxLifetime) })
+	}
+
+	// In half-close mode each copy direction may finish on its own; only
+	// tear down once both have, or as soon as anything fails.
+	var firstErr error
+	var results []taskResult // in the order they came in, for the debug log
+	for halfClosed := 0; firstErr == nil && halfClosed < 2; {
+		res := <-errCh
+		results = append(results, res)
+		switch err := res.err; {
+		case err == nil:
+			// The write queue drained after a half-close, or the first
+			// data arrived before the handshake timeout.
+		case errors.Is(err, errHalfClosed):
+			halfClosed++
+		default:
+			firstErr = err
+		}
+	}
+	first := len(results) - 1 // the result that ended the loop
+	cancel()
+
+	// A failed first write leaves the TCP side untouched so the caller can
+	// replay the data over a fresh WebSocket.
+	var fwErr *FirstWriteError
+	retry := errors.As(firstErr, &fwErr)
+
+	if !retry {
+		_ = tcpConn.SetDeadline(time.Now())
+	}
+	_ = ws.SetReadDeadline(time.Now())
+
+	closeCode := websocket.CloseNormalClosure
+	switch {
+	case errors.Is(firstErr, errTCPWriteTooBig), errors.Is(firstErr, ErrMemoryLimit), errors.Is(firstErr, ErrReassemblyLimit):
+		closeCode = websocket.CloseMessageTooBig
+	case errors.Is(firstErr, errUnexpectedFrame):
+		closeCode = websocket.CloseProtocolError
+	case errors.Is(firstErr, errFrameRate):
+		closeCode = websocket.ClosePolicyViolation
+	case errors.Is(firstErr, errTextFrame):
+		closeCode = websocket.CloseUnsupportedData
+	case errors.Is(firstErr, ErrPanic):
+		closeCode = websocket.CloseInternalServerErr
+	}
+	CloseWS(ws, &b.wsWriteMu, closeCode, closeReason(firstErr, context.Cause(parent)), cfg.CloseTimeout, cfg.SkipCloseHandshake)
+	if !retry {
+		_ = tcpConn.Close()
+	}
+
+	wg.Wait()
+	b.reasm.close()
+	if cfg.Debug {
+		close(errCh)
+		for res := range errCh {
+			results = append(results, res)
+		}
+		logTeardown(cfg.Tag, cfg.ConnID, first, results)
+	}
+
+	if retry {
+		if cfg.Counters.ToTCP.Load() == 0 {
+			return fwErr
+		}
+		// The backend got data to the player after all; too late to retry.
+		_ = tcpConn.Close()
+	}
+
+	if errors.Is(firstErr, errMaxLifetime) {
+		log.Println(cfg.Tag, "bridge closed: max connection lifetime", cfg.MaxLifetime, "reached")
+	} else if firstErr != nil && !errors.Is(firstErr, context.Canceled) && !errors.Is(firstErr, io.EOF) {
+		log.Println(cfg.Tag, "bridge closed:", firstErr)
+	}
+	if retry {
+		return fwErr.Err
+	}
+	return firstErr
+}
+
+// taskResult is what one of a bridge's goroutines returned.
+type taskResult struct {
+	name string
+	err  error
+}
+
+// logTeardown logs how every goroutine of a bridge ended, marking
+// results[first], the one that brought it down. Errors that only follow
+// from the teardown itself (context canceled, closed connections) are
+// included; on a flaky link the interesting part is often what the other
+// direction saw at the same time.
+func logTeardown(tag string, connID uint64, first int, results []taskResult) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s conn %d teardown:", tag, connID)
+	for i, res := range results {
+		mark := ""
+		if i == first {
+			mark = " (first)"
+		}
+		if res.err == nil {
+			fmt.Fprintf(&sb, "\n  %s%s: done", res.name, mark)
+		} else {
+			fmt.Fprintf(&sb, "\n  %s%s: %v", res.name, mark, res.err)
+		}
+	}
+	log.Println(sb.String())
+}
+
+// ExpectedClose reports whether err, as returned by Bridge, is an ordinary
+// way for a connection to end: a clean EOF or half-close, a canceled
+// context, the maximum lifetime, or a normal WebSocket close from the peer.
+func ExpectedClose(err error) bool {
+	var ce *websocket.CloseError
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, io.EOF),
+		errors.Is(err, net.ErrClosed),
+		errors.Is(err, errMaxLifetime):
+		return true
+	case errors.As(err, &ce):
+		return ce.Code == websocket.CloseNormalClosure || ce.Code == websocket.CloseGoingAway
+	}
+	return false
+}
+
+// maxCloseReason is what fits in a close frame after the 2-byte code.
+const maxCloseReason = 123
+
+// closeReason names why a bridge ended, for the close frame. cause is the
+// cancellation cause of the caller's context, if any.
+func closeReason(err, cause error) string {
+	var ne net.Error
+	var reason string
+	switch {
+	case err == nil:
+		reason = "half-closed"
+	case errors.Is(err, context.Canceled):
+		reason = "shutdown"
+		if cause != nil && cause != context.Canceled {
+			reason = cause.Error()
+		}
+	case errors.Is(err, errMaxLifetime):
+		reason = "max-lifetime"
+	case errors.Is(err, errHandshakeTimeout):
+		reason = "handshake-timeout"
+	case errors.Is(err, errTCPWriteTooBig):
+		reason = "frame-too-big"
+	case errors.Is(err, ErrMemoryLimit):
+		reason = "memory-limit"
+	case errors.Is(err, ErrReassemblyLimit):
+		reason = "reassembly-limit"
+	case errors.Is(err, errUnexpectedFrame):
+		reason = "unexpected-frame"
+	case errors.Is(err, errFrameRate):
+		reason = "frame-rate"
+	case errors.Is(err, errTextFrame):
+		reason = "text-frame"
+	case errors.Is(err, ErrPanic):
+		reason = "internal-error"
+	case errors.As(err, &ne) && ne.Timeout():
+		reason = "idle-timeout"
+	case errors.Is(err, errTCPRead) && errors.Is(err, io.EOF):
+		reason = "tcp-eof"
+	case errors.Is(err, errTCPRead), errors.Is(err, errTCPWrite):
+		reason = "tcp-error"
+	default:
+		reason = "ws-error"
+	}
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	return reason
+}
+
+// bridge is the state shared by the goroutines of one Bridge call.
+type bridge struct {
+	cfg       *Config
+	tcp       net.Conn
+	ws        *websocket.Conn
+	wsWriteMu sync.Mutex
+	out       *wsWriter
+
+	gotTCP, gotWS atomic.Bool // first data seen, for the handshake timeouts
+	idle          idleState
+
+	tcpFrames, wsFrames *frameLimiter // MaxFPS for each direction; nil = unlimited
+
+	memIn     *memBudget        // MaxConnMemory for WS messages on their way to TCP; nil = unlimited
+	readLimit int64             // largest WS message accepted
+	reasm     *bridgeReassembly // this bridge's part of cfg.Reassembly; nil = untracked
+}
+
+func (b *bridge) copyTCPToWS(ctx context.Context) error {
+	cfg, tcp, tag := b.cfg, b.tcp, b.cfg.Tag
+	buf := make([]byte, cfg.ReadBufferSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := tcp.Read(buf)
+		if err != nil {
+			if cfg.HalfClose && errors.Is(err, io.EOF) {
+				b.idle.tcpDone.Store(true)
+				return b.sendHalfClose(ctx)
+			}
+			return fmt.Errorf("%s %w: %w", tag, errTCPRead, err)
+		}
+		if n > 0 {
+			b.gotTCP.Store(true)
+			b.idle.touchTCP()
+		}
+		if n <= 0 {
+			// (0, nil) should not happen on a real TCP conn, but some
+			// net.Conn implementations do return it; back off instead of
+			// spinning on the read.
+			timer := time.NewTimer(ZeroReadBackoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			continue
+		}
+		if cfg.CoalesceDelay > 0 {
+			n = b.coalesceReads(buf, n)
+		}
+		if err := b.limitFrames(ctx, b.tcpFrames, "TCP"); err != nil {
+			return err
+		}
+
+		slice := buf[:n]
+		if cfg.DumpBytes {
+			DumpHex(fmt.Sprintf("%s conn %d TCP->WS (%d)", tag, cfg.ConnID, n), slice, cfg.DumpWidth)
+		} else if cfg.Debug {
+			log.Printf("%s TCP->WS (%d)", tag, n)
+		}
+		if cfg.Capture != nil {
+			cfg.Capture(false, slice)
+		}
+
+		// Never send a frame larger than the peer's read limit.
+		for len(slice) > 0 {
+			chunk := slice
+			if int64(len(chunk)) > cfg.MaxFramePayload {
+				chunk = chunk[:cfg.MaxFramePayload]
+			}
+			slice = slice[len(chunk):]
+
+			if err := cfg.RateLimit.Wait(ctx, len(chunk)); err != nil {
+				return err
+			}
+			if err := b.out.send(ctx, chunk); err != nil {
+				if b.out.queue == nil && cfg.Counters.ToWS.Load() == 0 && cfg.Counters.ToTCP.Load() == 0 {
+					return &FirstWriteError{Data: append([]byte{}, buf[:n]...), Err: err}
+				}
+				return err
+			}
+			cfg.Counters.ToWS.Add(int64(len(chunk)))
+		}
+	}
+}
+
+func (b *bridge) copyWSToTCP(ctx context.Context) error {
+	if b.cfg.StreamFrames {
+		return b.copyWSToTCPStreamed(ctx)
+	}
+	if b.cfg.CorkWrites && corkSupported {
+		// Corking the socket under a wrapper (TLS, a replayed prefix) is
+		// fine: the wrapper's writes still land in the corked socket.
+		if sc, ok := InnerConn(b.tcp).(syscall.Conn); ok {
+			return b.copyWSToTCPCorked(ctx, sc)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := b.memIn.acquire(ctx, b.readLimit); err != nil {
+			return err
+		}
+		msgType, data, err := b.readMessage()
+		if err != nil {
+			return b.wsReadErr(err)
+		}
+		b.memIn.release(b.readLimit - int64(len(data)))
+		// Data counts as liveness too, so a CDN that drops control frames
+		// does not kill a busy connection once pongs stop arriving.
+		b.idle.touchWS()
+		if err := b.limitFrames(ctx, b.wsFrames, "WS"); err != nil {
+			return err
+		}
+
+		err = b.handleWSMessage(ctx, msgType, data)
+		b.reasm.release(int64(len(data)))
+		if err != nil {
+			return err
+		}
+		b.memIn.release(int64(len(data)))
+	}
+}
+
+// copyWSToTCPCorked is copyWSToTCP for CorkWrites. A separate goroutine
+// reads frames into a queue; while more frames are waiting, TCP_CORK holds
+// the writes back so they leave in full segments, and the socket is
+// uncorked as soon as the queue is empty. The reader ends once the bridge
+// closes the WebSocket.
+func (b *bridge) copyWSToTCPCorked(ctx context.Context, sc syscall.Conn) error {
+	type wsMsg struct {
+		typ  int
+		data []byte
+		err  error
+	}
+	tag := b.cfg.Tag
+	queue := make(chan wsMsg, corkQueueSize)
+	go func() {
+		err := CatchPanic(fmt.Sprintf("%s conn %d", tag, b.cfg.ConnID), func() error {
+			for {
+				if err := b.memIn.acquire(ctx, b.readLimit); err != nil {
+					return nil
+				}
+				msgType, data, err := b.readMessage()
+				if err == nil {
+					b.idle.touchWS()
+					b.memIn.release(b.readLimit - int64(len(data)))
+				}
+				select {
+				case queue <- wsMsg{msgType, data, err}:
+				case <-ctx.Done():
+					return nil
+				}
+				if err != nil {
+					return nil
+				}
+			}
+		})
+		if err != nil {
+			select {
+			case queue <- wsMsg{err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	corked := false
+	defer func() {
+		if corked {
+			_ = setCork(sc, false)
+		}
+	}()
+	for {
+		var m wsMsg
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m = <-queue:
+		}
+		if m.err != nil {
+			return b.wsReadErr(m.err)
+		}
+		if err := b.limitFrames(ctx, b.wsFrames, "WS"); err != nil {
+			return err
+		}
+		if !corked && len(queue) > 0 {
+			corked = setCork(sc, true) == nil
+		}
+		err := b.handleWSMessage(ctx, m.typ, m.data)
+		b.reasm.release(int64(len(m.data)))
+		if err != nil {
+			return err
+		}
+		b.memIn.release(int64(len(m.data)))
+		if corked && len(queue) == 0 {
+			_ = setCork(sc, false)
+			corked = false
+		}
+	}
+}
+
+// copyWSToTCPStreamed is copyWSToTCP for StreamFrames. Binary messages
+// are read with NextReader and written to TCP one ReadBufferSize piece at a
+// time, so a message of any size costs one buffer. MaxTCPWrite applies to
+// the whole message: the pieces before the one that crosses it have
+// already been written. Other messages are small control traffic and are
+// read whole, up to MaxFramePayload, and handled as usual.
+func (b *bridge) copyWSToTCPStreamed(ctx context.Context) error {
+	cfg, ws, tag := b.cfg, b.ws, b.cfg.Tag
+	buf := make([]byte, cfg.ReadBufferSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		msgType, r, err := ws.NextReader()
+		if err != nil {
+			return b.wsReadErr(err)
+		}
+		b.idle.touchWS()
+		if err := b.limitFrames(ctx, b.wsFrames, "WS"); err != nil {
+			return err
+		}
+
+		if msgType != websocket.BinaryMessage {
+			if err := b.memIn.acquire(ctx, b.readLimit); err != nil {
+				return err
+			}
+			data, err := io.ReadAll(io.LimitReader(r, b.readLimit+1))
+			if err != nil {
+				return b.wsReadErr(err)
+			}
+			if int64(len(data)) > b.readLimit {
+				return b.wsReadErr(websocket.ErrReadLimit)
+			}
+			if err := b.handleWSMessage(ctx, msgType, data); err != nil {
+				return err
+			}
+			b.memIn.release(b.readLimit)
+			continue
+		}
+
+		b.gotWS.Store(true)
+		total := 0
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				b.idle.touchWS()
+				total += n
+				if cfg.MaxTCPWrite > 0 && total > cfg.MaxTCPWrite {
+					return fmt.Errorf("%s %w: message over %d bytes", tag, errTCPWriteTooBig, cfg.MaxTCPWrite)
+				}
+				if err := b.writeTCP(ctx, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return b.wsReadErr(err)
+			}
+		}
+		if cfg.HalfClose && total == 0 {
+			return b.closeTCPWrite()
+		}
+	}
+}
+
+// handleWSMessage acts on one frame read from the WebSocket. A non-nil
+// error ends the WS->TCP direction.
+func (b *bridge) handleWSMessage(ctx context.Context, msgType int, data []byte) error {
+	cfg, tag := b.cfg, b.cfg.Tag
+	switch msgType {
+	case websocket.BinaryMessage:
+		b.gotWS.Store(true)
+		if cfg.HalfClose && len(data) == 0 {
+			return b.closeTCPWrite()
+		}
+		return b.writeTCP(ctx, data)
+	case websocket.CloseMessage:
+		return io.EOF
+	case websocket.TextMessage:
+		if cfg.OnText != nil {
+			cfg.OnText(data)
+			return nil
+		}
+		switch cfg.TextFrames {
+		case TextLog:
+			log.Printf("%s dropped text frame (%d bytes)", tag, len(data))
+		case TextError:
+			if cfg.StrictFrames {
+				return fmt.Errorf("%s %w: %w (%d bytes)", tag, errUnexpectedFrame, errTextFrame, len(data))
+			}
+			return fmt.Errorf("%s %w (%d bytes)", tag, errTextFrame, len(data))
+		case TextForward:
+			if len(data) > 0 {
+				return b.writeTCP(ctx, data)
+			}
+		}
+	default:
+		if cfg.StrictFrames {
+			return fmt.Errorf("%s %w: %d", tag, errUnexpectedFrame, msgType)
+		}
+		if cfg.Debug {
+			log.Printf("%s unsupported WS frame type: %d", tag, msgType)
+		}
+	}
+	return nil
+}
+
+// writeTCP writes the payload of one frame to TCP.
+func (b *bridge) writeTCP(ctx context.Context, data []byte) error {
+	cfg, tag := b.cfg, b.cfg.Tag
+	if cfg.MaxTCPWrite > 0 && len(data) > cfg.MaxTCPWrite {
+		return fmt.Errorf("%s %w: %d > %d bytes", tag, errTCPWriteTooBig, len(data), cfg.MaxTCPWrite)
+	}
+	if err := cfg.RateLimit.Wait(ctx, len(data)); err != nil {
+		return err
+	}
+	if cfg.DumpBytes {
+		DumpHex(fmt.Sprintf("%s conn %d WS->TCP (%d)", tag, cfg.ConnID, len(data)), data, cfg.DumpWidth)
+	} else if cfg.Debug {
+		log.Printf("%s WS->TCP (%d)", tag, len(data))
+	}
+	if cfg.Capture != nil {
+		cfg.Capture(true, data)
+	}
+
+	_ = b.tcp.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+	n, err := b.tcp.Write(data)
+	cfg.Counters.ToTCP.Add(int64(n))
+	if err != nil {
+		return fmt.Errorf("%s %w: %w", tag, errTCPWrite, err)
+	}
+	if cfg.TCPWriteIdle {
+		// The peer took the data, so the connection is alive even if it
+		// has nothing to say.
+		b.idle.touchTCP()
+	}
+	return nil
+}
+
+// coalesceReads keeps reading whatever else arrives within CoalesceDelay
+// of the first read into buf[n:], so bursts of tiny packets go out as one
+// frame. It stops early once a full frame's worth is buffered. Errors are
+// left for the next regular read to report.
+func (b *bridge) coalesceReads(buf []byte, n int) int {
+	limit := len(buf)
+	if int64(limit) > b.cfg.MaxFramePayload {
+		limit = int(b.cfg.MaxFramePayload)
+	}
+	_ = b.tcp.SetReadDeadline(time.Now().Add(b.cfg.CoalesceDelay))
+	defer b.tcp.SetReadDeadline(time.Time{})
+	for n < limit {
+		m, err := b.tcp.Read(buf[n:limit])
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	return n
+}
+
+// sendHalfClose tells the peer that no more data will follow in this
+// direction. An empty binary frame is used as the marker: copyTCPToWS never
+// emits one otherwise, and a peer without half-close just writes zero bytes.
+func (b *bridge) sendHalfClose(ctx context.Context) error {
+	if b.cfg.Debug {
+		log.Println(b.cfg.Tag, "TCP EOF, half-closing WS direction")
+	}
+	if err := b.out.send(ctx, nil); err != nil {
+		return err
+	}
+	if err := b.out.flush(ctx); err != nil {
+		return err
+	}
+	return errHalfClosed
+}
+
+// closeTCPWrite handles the peer's half-close marker by shutting down the
+// write side of the TCP connection.
+func (b *bridge) closeTCPWrite() error {
+	if b.cfg.Debug {
+		log.Println(b.cfg.Tag, "peer half-closed, closing TCP write side")
+	}
+	b.idle.wsDone.Store(true)
+	if c, ok := b.tcp.(CloseWriter); ok {
+		if err := c.CloseWrite(); err != nil {
+			return fmt.Errorf("%s TCP close write: %w", b.cfg.Tag, err)
+		}
+	}
+	return errHalfClosed
+}
+
+// statsLoop sends cfg.Stats as a text frame every StatsInterval.
+func (b *bridge) statsLoop(ctx context.Context) error {
+	ticker := time.NewTicker(b.cfg.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			msg := b.cfg.Stats()
+			b.wsWriteMu.Lock()
+			_ = b.ws.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+			err := b.ws.WriteMessage(websocket.TextMessage, msg)
+			b.wsWriteMu.Unlock()
+			if err != nil {
+				return fmt.Errorf("%s WS stats write: %w", b.cfg.Tag, err)
+			}
+		}
+	}
+}
+
+// wsWriter sends binary frames to the WebSocket. By default each frame is
+// written directly under the write lock; with a write queue frames go
+// through a bounded queue drained by run, so a slow WS write does not hold up
+// TCP reads until the queue fills.
+type wsWriter struct {
+	ws    *websocket.Conn
+	mu    *sync.Mutex
+	tag   string
+	queue chan []byte   // nil in synchronous mode
+	done  chan struct{} // closed when run returns
+	mem   *memBudget    // bytes in queue; nil = only the queue length bounds them
+}
+
+func newWSWriter(ws *websocket.Conn, mu *sync.Mutex, tag string, queueSize int) *wsWriter {
+	w := &wsWriter{ws: ws, mu: mu, tag: tag}
+	if queueSize > 0 {
+		w.queue = make(chan []byte, queueSize)
+		w.done = make(chan struct{})
+	}
+	return w
+}
+
+func (w *wsWriter) write(data []byte) error {
+	w.mu.Lock()
+	_ = w.ws.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+	err := w.ws.WriteMessage(websocket.BinaryMessage, data)
+	w.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%s WS write: %w", w.tag, err)
+	}
+	return nil
+}
+
+// send writes data or queues a copy of it; data may be reused afterwards.
+// With a full queue it blocks, which stops the caller from reading more TCP.
+func (w *wsWriter) send(ctx context.Context, data []byte) error {
+	if w.queue == nil {
+		return w.write(data)
+	}
+	if err := w.mem.acquire(ctx, int64(len(data))); err != nil {
+		return err
+	}
+	frame := append([]byte{}, data...)
+	select {
+	case w.queue <- frame:
+		return nil
+	case <-w.done:
+		return fmt.Errorf("%s WS write queue stopped", w.tag)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush closes the queue and waits until everything in it has been written.
+// No more frames may be sent afterwards.
+func (w *wsWriter) flush(ctx context.Context) error {
+	if w.queue == nil {
+		return nil
+	}
+	close(w.queue)
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run drains the queue. It returns nil once the queue is flushed.
+func (w *wsWriter) run(ctx context.Context) error {
+	defer close(w.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case data, ok := <-w.queue:
+			if !ok {
+				return nil
+			}
+			if err := w.write(data); err != nil {
+				return err
+			}
+			w.mem.release(int64(len(data)))
+		}
+	}
+}
+
+// PingLoop sends a ping every interval under wsMu until ctx is done or a
+// ping fails. A nil wsMu sends them unlocked, relying on WriteControl being
+// safe to call next to the connection's writer. With jitter > 0 each wait is drawn uniformly from
+// interval ± jitter*interval, and the first one from [0, interval), so
+// connections opened together do not ping together; the average interval
+// stays the same.
+func PingLoop(ctx context.Context, ws *websocket.Conn, wsMu *sync.Mutex, interval time.Duration, jitter float64, tag string) error {
+	return pingLoop(ctx, ws, wsMu, interval, jitter, tag, nil)
+}
+
+// pingLoop is PingLoop with each ping's payload from payload, or empty if
+// payload is nil.
+func pingLoop(ctx context.Context, ws *websocket.Conn, wsMu *sync.Mutex, interval time.Duration, jitter float64, tag string, payload func() []byte) error {
+	next := func() time.Duration {
+		if jitter <= 0 {
+			return interval
+		}
+		return interval + time.Duration((2*rand.Float64()-1)*jitter*float64(interval))
+	}
+	first := interval
+	if jitter > 0 {
+		first = time.Duration(rand.Int63n(int64(interval)))
+	}
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			timer.Reset(next())
+			if wsMu != nil {
+				wsMu.Lock()
+			}
+			var data []byte
+			if payload != nil {
+				// Stamped once any lock is held, so waiting for it does not count.
+				data = payload()
+			}
+			err := ws.WriteControl(websocket.PingMessage, data, time.Now().Add(TCPWriteTimeout))
+			if wsMu != nil {
+				wsMu.Unlock()
+			}
+			if err != nil {
+				return fmt.Errorf("%s WS ping: %w", tag, err)
+			}
+		}
+	}
+}
+
+// lifetimeTimer returns errMaxLifetime once d has elapsed. The timer is
+// stopped when the bridge tears down for any other reason.
+func lifetimeTimer(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errMaxLifetime
+	}
+}
+
+// CloseWS sends a close frame under wsMu and closes ws. The whole call
+// takes at most timeout (0 = CloseWait), even with a write stuck on a dead
+// peer: the socket's write deadline is pulled in first, so the stuck write
+// fails and releases wsMu. With skip, no close frame is sent.
+func CloseWS(ws *websocket.Conn, wsMu *sync.Mutex, code int, reason string, timeout time.Duration, skip bool) {
+	if timeout <= 0 {
+		timeout = CloseWait
+	}
+	if !skip {
+		deadline := time.Now().Add(timeout)
+		_ = ws.UnderlyingConn().SetWriteDeadline(deadline)
+		wsMu.Lock()
+		_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		wsMu.Unlock()
+	}
+	_ = ws.Close()
+}
+
+// handshakeTimer returns errHandshakeTimeout if got is still false once d
+// has elapsed, and nil otherwise.
+func handshakeTimer(ctx context.Context, got *atomic.Bool, d time.Duration, side string) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if got.Load() {
+		return nil
+	}
+	return fmt.Errorf("%w: no data from %s within %v", errHandshakeTimeout, side, d)
+}
+
+// DefaultDumpWidth is the DumpHex line width used when none is given.
+const DefaultDumpWidth = 16
+
+// DumpHex logs data in one block: the header line, then width bytes per
+// line with an offset column and an ASCII gutter, like hexdump -C.
+func DumpHex(header string, data []byte, width int) {
+	if width <= 0 {
+		width = DefaultDumpWidth
+	}
+	var sb strings.Builder
+	sb.WriteString(header)
+	for off := 0; off < len(data); off += width {
+		line := data[off:min(off+width, len(data))]
+		fmt.Fprintf(&sb, "\n%08x ", off)
+		for i := 0; i < width; i++ {
+			if i%8 == 0 {
+				sb.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(&sb, "%02x ", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+		}
+		sb.WriteString(" |")
+		for _, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			sb.WriteByte(b)
+		}
+		sb.WriteByte('|')
+	}
+	log.Print(sb.String())
+}
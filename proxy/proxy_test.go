@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns both ends of a WebSocket connection over loopback: server
+// is what a Bridge runs on, client plays the peer (the other proxy).
+func wsPair(t testing.TB) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	var up websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("upgrade:", err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return <-conns, client
+}
+
+// testConfig is a Config with every optional feature off and no pings
+// within the length of a test.
+func testConfig() Config {
+	return Config{
+		Tag:             "[TEST]",
+		MaxFramePayload: 1 << 20,
+		ReadBufferSize:  8192,
+		PingInterval:    time.Hour,
+	}
+}
+
+// startBridge runs Bridge in the background. The bridge is torn down, and
+// waited for, when the test ends.
+func startBridge(t testing.TB, tcp net.Conn, ws *websocket.Conn, cfg Config) <-chan error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		done <- Bridge(ctx, tcp, ws, cfg)
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Error("bridge did not stop")
+		}
+	})
+	return done
+}
+
+// tcpPair returns both ends of a loopback TCP connection, closed when the
+// test ends.
+func tcpPair(t testing.TB) (server, client net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+// readBinary reads one binary message from the peer end.
+func readBinary(t testing.TB, c *websocket.Conn) []byte {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal("peer read:", err)
+	}
+	if typ != websocket.BinaryMessage {
+		t.Fatalf("peer got message type %d, want binary", typ)
+	}
+	return msg
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestLargeReadSplitAtMaxFramePayload(t *testing.T) {
+	ws, peer := wsPair(t)
+	tcp, player := net.Pipe()
+	t.Cleanup(func() { player.Close() })
+
+	cfg := testConfig()
+	cfg.MaxFramePayload = 1000
+	cfg.ReadBufferSize = 8192
+	startBridge(t, tcp, ws, cfg)
+
+	// One write on a pipe fills one read, so the bridge gets all of it at
+	// once and has to split it itself.
+	data := randomBytes(cfg.ReadBufferSize)
+	go player.Write(data)
+
+	var got []byte
+	frames := 0
+	for len(got) < len(data) {
+		msg := readBinary(t, peer)
+		if int64(len(msg)) > cfg.MaxFramePayload {
+			t.Fatalf("frame of %d bytes, over MaxFramePayload %d", len(msg), cfg.MaxFramePayload)
+		}
+		got = append(got, msg...)
+		frames++
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data changed on the way through")
+	}
+	if want := (len(data) + 999) / 1000; frames != want {
+		t.Errorf("got %d frames, want %d", frames, want)
+	}
+}
+
+// wrappedConn hands out what it wraps through NetConn, like the main
+// package's connection wrappers.
+type wrappedConn struct{ net.Conn }
+
+func (c wrappedConn) NetConn() net.Conn { return c.Conn }
+
+func TestInnerConn(t *testing.T) {
+	raw, other := net.Pipe()
+	defer raw.Close()
+	defer other.Close()
+	for name, c := range map[string]net.Conn{
+		"bare":         raw,
+		"wrapped":      wrappedConn{raw},
+		"TLS":          tls.Server(raw, &tls.Config{}),
+		"TLS, wrapped": wrappedConn{tls.Server(wrappedConn{raw}, &tls.Config{})},
+	} {
+		if got := InnerConn(c); got != raw {
+			t.Errorf("%s: InnerConn returned %T, want the pipe", name, got)
+		}
+	}
+}
+
+func TestCorkThroughWrapper(t *testing.T) {
+	ws, peer := wsPair(t)
+	tcp, player := tcpPair(t)
+	cfg := testConfig()
+	cfg.CorkWrites = true
+	startBridge(t, wrappedConn{tcp}, ws, cfg)
+
+	data := randomBytes(64 << 10)
+	go func() {
+		for off := 0; off < len(data); off += 1000 {
+			if err := peer.WriteMessage(websocket.BinaryMessage, data[off:min(off+1000, len(data))]); err != nil {
+				return
+			}
+		}
+	}()
+	got := make([]byte, len(data))
+	_ = player.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(player, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("player got %v, data changed on the way through", err)
+	}
+}
+
+// zeroReadConn is a net.Conn whose Read returns (0, nil) until it is
+// closed, counting the calls.
+type zeroReadConn struct {
+	net.Conn // nil; only the methods below are used
+	reads    atomic.Int64
+	closed   atomic.Bool
+}
+
+func (c *zeroReadConn) Read([]byte) (int, error) {
+	c.reads.Add(1)
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return 0, nil
+}
+
+func (c *zeroReadConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *zeroReadConn) Close() error                     { c.closed.Store(true); return nil }
+func (c *zeroReadConn) SetDeadline(time.Time) error      { return nil }
+func (c *zeroReadConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *zeroReadConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestZeroReadDoesNotSpin(t *testing.T) {
+	ws, _ := wsPair(t)
+	tcp := new(zeroReadConn)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Bridge(ctx, tcp, ws, testConfig()) }()
+
+	const wait = 200 * time.Millisecond
+	time.Sleep(wait)
+	// A spinning loop does millions of reads in this time; backing off
+	// ZeroReadBackoff after each allows about wait/ZeroReadBackoff.
+	if n, limit := tcp.reads.Load(), int64(2*wait/ZeroReadBackoff); n > limit {
+		t.Errorf("%d reads in %v, want at most %d", n, wait, limit)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("bridge did not notice the canceled context")
+	}
+}
+
+// pattern is the byte at offset i of the test stream below.
+func pattern(i int) byte { return byte(i*7 ^ i>>9) }
+
+func TestStreamFramesMemoryBounded(t *testing.T) {
+	ws, peer := wsPair(t)
+	// Loopback TCP rather than net.Pipe, whose deadlines allocate a timer
+	// each time they are set.
+	tcp, player := tcpPair(t)
+
+	cfg := testConfig()
+	cfg.StreamFrames = true
+	startBridge(t, tcp, ws, cfg)
+
+	// One message of 64 times MaxFramePayload, written and checked a
+	// chunk at a time so the test itself holds none of it.
+	const size = 64 << 20
+	go func() {
+		w, err := peer.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			t.Error("peer write:", err)
+			return
+		}
+		chunk := make([]byte, 32<<10)
+		for off := 0; off < size; off += len(chunk) {
+			for i := range chunk {
+				chunk[i] = pattern(off + i)
+			}
+			if _, err := w.Write(chunk); err != nil {
+				t.Error("peer write:", err)
+				return
+			}
+		}
+		w.Close()
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	buf := make([]byte, 32<<10)
+	_ = player.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for off := 0; off < size; {
+		n, err := player.Read(buf)
+		for i := 0; i < n; i++ {
+			if buf[i] != pattern(off+i) {
+				t.Fatalf("byte %d changed on the way through", off+i)
+			}
+		}
+		off += n
+		if err != nil {
+			t.Fatalf("player read at %d of %d bytes: %v", off, size, err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+
+	// Reading the message whole would allocate all of it at least once.
+	alloc := after.TotalAlloc - before.TotalAlloc
+	t.Logf("%d MB message, %d KB allocated", size>>20, alloc>>10)
+	if alloc > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d byte message, want it streamed", alloc, size)
+	}
+}
+
+// BenchmarkCoalesce pushes 1MB per iteration through a bridge in
+// Minecraft-sized 100-byte writes and reports how many WebSocket frames it
+// took, with CoalesceDelay off and on.
+func BenchmarkCoalesce(b *testing.B) {
+	for _, delay := range []time.Duration{0, 2 * time.Millisecond} {
+		name := "off"
+		if delay > 0 {
+			name = delay.String()
+		}
+		b.Run(name, func(b *testing.B) {
+			ws, peer := wsPair(b)
+			tcp, player := net.Pipe()
+			b.Cleanup(func() { player.Close() })
+			cfg := testConfig()
+			cfg.CoalesceDelay = delay
+			startBridge(b, tcp, ws, cfg)
+
+			const total, packet = 1 << 20, 100
+			go func() {
+				buf := make([]byte, packet)
+				for i := 0; i < b.N; i++ {
+					for sent := 0; sent < total; sent += packet {
+						if _, err := player.Write(buf[:min(packet, total-sent)]); err != nil {
+							return
+						}
+					}
+				}
+			}()
+
+			b.SetBytes(total)
+			b.ResetTimer()
+			frames := 0
+			for got := 0; got < b.N*total; frames++ {
+				got += len(readBinary(b, peer))
+			}
+			b.ReportMetric(float64(frames)/float64(b.N), "frames/MB")
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateChunk is the most a single reservation takes from a RateLimiter, so
+// a connection moving a large buffer queues behind others chunk by chunk
+// instead of holding the bucket for the whole buffer.
+const rateChunk = 16 * 1024
+
+// RateLimiter is a token bucket in bytes per second that any number of
+// bridges can share. The zero value is not usable; a nil *RateLimiter
+// never waits.
+type RateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64 // negative while callers are waiting for their share
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for bytesPerSec with a burst of 100ms
+// worth of traffic (at least one chunk).
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	burst := max(float64(bytesPerSec)/10, rateChunk)
+	return &RateLimiter{rate: float64(bytesPerSec), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait blocks until n bytes may be sent or ctx is done. Each chunk is
+// reserved in turn, so concurrent callers are served in arrival order.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		take := min(n, rateChunk)
+		n -= take
+
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		l.tokens -= float64(take)
+		wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if wait <= 0 {
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
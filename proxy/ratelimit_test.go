@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitCapsBridgesTogether(t *testing.T) {
+	const rate = 256 << 10 // bytes per second, shared
+	const bridges = 3
+	limiter := NewRateLimiter(rate)
+
+	got := make([]atomic.Int64, bridges)
+	start := time.Now()
+	for i := range got {
+		ws, peer := wsPair(t)
+		tcp, player := net.Pipe()
+		t.Cleanup(func() { player.Close() })
+		cfg := testConfig()
+		cfg.RateLimit = limiter
+		startBridge(t, tcp, ws, cfg)
+
+		// Each player uploads as fast as the bridge lets it.
+		go func() {
+			buf := make([]byte, cfg.ReadBufferSize)
+			for {
+				if _, err := player.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+		n := &got[i]
+		go func() {
+			for {
+				_, msg, err := peer.ReadMessage()
+				if err != nil {
+					return
+				}
+				n.Add(int64(len(msg)))
+			}
+		}()
+	}
+
+	time.Sleep(time.Second)
+	var total int64
+	for i := range got {
+		total += got[i].Load()
+	}
+	elapsed := time.Since(start).Seconds()
+	t.Logf("%d bytes in %.2fs through %d bridges, cap %d/s", total, elapsed, bridges, rate)
+
+	if limit := rate*elapsed + limiter.burst; float64(total) > limit {
+		t.Errorf("%d bytes in %.2fs, over the cap of %.0f (rate plus burst)", total, elapsed, limit)
+	}
+	if float64(total) < rate*elapsed/2 {
+		t.Errorf("%d bytes in %.2fs, far below the cap", total, elapsed)
+	}
+	for i := range got {
+		if n := got[i].Load(); n < total/(3*bridges) {
+			t.Errorf("bridge %d got %d of %d bytes, starved by the others", i, n, total)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrReassemblyLimit ends a bridge whose peer sent a large WebSocket
+// message while the bytes held by all bridges were over a Reassembly's cap.
+var ErrReassemblyLimit = errors.New("message exceeds -max-total-reassembly")
+
+// Reassembly tracks the bytes of WebSocket messages that all bridges
+// sharing it have read but not yet written to TCP, and optionally caps
+// them. Whole-message reads can hold up to MaxFramePayload per bridge, so
+// many peers sending large fragmented messages at once add up. Over the
+// cap, a message is refused once it grows past one ReadBufferSize; smaller
+// ones, which is most Minecraft traffic, always go through. A nil
+// *Reassembly tracks nothing.
+type Reassembly struct {
+	limit int64 // 0 = no cap
+	used  atomic.Int64
+}
+
+// NewReassembly returns a tracker capped at limit bytes, or uncapped for 0.
+func NewReassembly(limit int64) *Reassembly {
+	return &Reassembly{limit: limit}
+}
+
+// InUse returns the bytes currently held.
+func (r *Reassembly) InUse() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.used.Load()
+}
+
+// bridgeReassembly is one bridge's share of a Reassembly. What is still held
+// when the bridge ends is handed back in close; after that nothing is
+// counted, so a reader goroutine that outlives the bridge cannot leak.
+type bridgeReassembly struct {
+	shared *Reassembly
+
+	mu     sync.Mutex
+	held   int64
+	closed bool
+}
+
+// grow accounts n more bytes of a message. large says the message is past
+// its first ReadBufferSize and may be refused.
+func (br *bridgeReassembly) grow(n int64, large bool) bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.closed {
+		return false
+	}
+	if used := br.shared.used.Add(n); large && br.shared.limit > 0 && used > br.shared.limit {
+		br.shared.used.Add(-n)
+		return false
+	}
+	br.held += n
+	return true
+}
+
+func (br *bridgeReassembly) release(n int64) {
+	if br == nil || n == 0 {
+		return
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.closed {
+		return
+	}
+	br.held -= n
+	br.shared.used.Add(-n)
+}
+
+func (br *bridgeReassembly) close() {
+	if br == nil {
+		return
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.shared.used.Add(-br.held)
+	br.held, br.closed = 0, true
+}
+
+// readMessage is ws.ReadMessage with the message accounted in b.reasm as it
+// is read, one ReadBufferSize at a time. The caller releases len(data) once
+// it is done with data.
+func (b *bridge) readMessage() (int, []byte, error) {
+	if b.reasm == nil {
+		return b.ws.ReadMessage()
+	}
+	msgType, r, err := b.ws.NextReader()
+	if err != nil {
+		return msgType, nil, err
+	}
+	var data []byte
+	chunk := b.cfg.ReadBufferSize
+	for {
+		if cap(data)-len(data) < chunk {
+			data = append(data, make([]byte, chunk)...)[:len(data)]
+		}
+		n, err := r.Read(data[len(data) : len(data)+chunk])
+		if n > 0 {
+			if !b.reasm.grow(int64(n), len(data)+n > chunk) {
+				b.reasm.release(int64(len(data)))
+				return msgType, nil, fmt.Errorf("%w (%d bytes)", ErrReassemblyLimit, b.reasm.shared.limit)
+			}
+			data = data[:len(data)+n]
+		}
+		if err == io.EOF {
+			return msgType, data, nil
+		}
+		if err != nil {
+			b.reasm.release(int64(len(data)))
+			return msgType, nil, err
+		}
+	}
+}
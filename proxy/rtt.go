@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// rttMagic starts the payload of a ping that carries an RTT beacon. Any
+// conforming peer echoes the payload in its pong, so the exit needs no
+// support for this; pongs without the magic are not beacons.
+const rttMagic = "MCWSRTT1"
+
+// rttBase anchors beacon timestamps, so time.Since reads the monotonic
+// clock.
+var rttBase = time.Now()
+
+// rttBeacon returns a ping payload stamped with the current time.
+func rttBeacon() []byte {
+	b := make([]byte, len(rttMagic)+8)
+	copy(b, rttMagic)
+	binary.BigEndian.PutUint64(b[len(rttMagic):], uint64(time.Since(rttBase)))
+	return b
+}
+
+// parseRTTBeacon returns the round trip of a pong echoing an rttBeacon.
+// Anything else, including a stamp from the future, is not one.
+func parseRTTBeacon(appData string) (time.Duration, bool) {
+	if len(appData) != len(rttMagic)+8 || appData[:len(rttMagic)] != rttMagic {
+		return 0, false
+	}
+	sent := time.Duration(binary.BigEndian.Uint64([]byte(appData[len(rttMagic):])))
+	rtt := time.Since(rttBase) - sent
+	if sent < 0 || rtt < 0 {
+		return 0, false
+	}
+	return rtt, true
+}
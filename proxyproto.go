@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"mc-ws-proxy/proxy"
+)
+
+var (
+	proxyProtocolMode   = flag.String("proxy-protocol", "off", "on the entry, PROXY protocol v1/v2 header (HAProxy, AWS NLB) handling: require (every player connection must start with one), auto (use it when a connection starts with one, otherwise treat the connection as a direct player) or off")
+	acceptProxyProtocol = flag.Bool("accept-proxy-protocol", false, "same as -proxy-protocol require")
+	exitProxyProtocol   = flag.String("exit-proxy-protocol", "off", "on the exit, send a PROXY protocol header (v1 or v2) carrying the player's address to the target before any data, for a server that expects one (Velocity, BungeeCord, Paper with proxy-protocol on); the address is the one from -proxy-hello, otherwise the upgrade's source as resolved with -trusted-proxies (off = send none)")
+)
+
+///////////////////////
+//  入口机：解析 PROXY protocol 头（v1 文本 / v2 二进制）
+///////////////////////
+
+const (
+	proxyV1MaxLen = 107 // including CRLF, per the spec
+	proxyV2Fixed  = 16  // signature, version/command, family, length
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("bad PROXY protocol header")
+
+// proxiedConn is a player connection whose real address came from a PROXY
+// header; RemoteAddr reports that address instead of the load balancer's.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the load balancer's connection, so proxy.InnerConn can
+// reach the socket.
+func (c *proxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// parseProxyProtocolMode checks -proxy-protocol and -exit-proxy-protocol
+// and folds -accept-proxy-protocol into the former.
+func parseProxyProtocolMode() error {
+	switch *exitProxyProtocol {
+	case "off", "v1", "v2":
+	default:
+		return fmt.Errorf("unknown -exit-proxy-protocol: %s (must be off, v1 or v2)", *exitProxyProtocol)
+	}
+	switch *proxyProtocolMode {
+	case "off":
+		if *acceptProxyProtocol {
+			*proxyProtocolMode = "require"
+		}
+	case "require", "auto":
+		if *acceptProxyProtocol && *proxyProtocolMode != "require" {
+			return fmt.Errorf("-accept-proxy-protocol conflicts with -proxy-protocol %s", *proxyProtocolMode)
+		}
+	default:
+		return fmt.Errorf("unknown -proxy-protocol: %s (must be off, require or auto)", *proxyProtocolMode)
+	}
+	return nil
+}
+
+// acceptProxyHeader reads the PROXY header at the start of c, consuming
+// exactly its bytes, and returns c wrapped to report the client address.
+// A LOCAL (v2) or UNKNOWN (v1) header keeps the load balancer's address.
+// With -proxy-protocol auto, a connection that does not start with a header
+// is returned with the bytes looked at put back in front.
+func acceptProxyHeader(c net.Conn) (net.Conn, error) {
+	_ = c.SetReadDeadline(time.Now().Add(handshakeReadTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var r io.Reader = c
+	if *proxyProtocolMode == "auto" {
+		seen, isHeader, err := sniffProxyHeader(c)
+		if err != nil {
+			return nil, err
+		}
+		if !isHeader {
+			return newPrefixConn(c, seen), nil
+		}
+		r = io.MultiReader(bytes.NewReader(seen), c)
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+	var ap netip.AddrPort
+	var err error
+	switch first[0] {
+	case 'P':
+		ap, err = readProxyV1(r)
+	case proxyV2Sig[0]:
+		ap, err = readProxyV2(r)
+	default:
+		err = fmt.Errorf("%w: starts with 0x%02X", errBadProxyHeader, first[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ap.IsValid() {
+		return c, nil
+	}
+	return &proxiedConn{Conn: c, remote: net.TCPAddrFromAddrPort(ap)}, nil
+}
+
+// proxyV1Sig is how every v1 header starts.
+var proxyV1Sig = []byte("PROXY ")
+
+// sniffProxyHeader reads c one byte at a time for as long as what it has
+// read could still be the start of a v1 or v2 signature, and reports
+// whether a whole signature came in. A Minecraft stream gives itself away
+// by the second byte: its first packet has ID 0x00 (or is the legacy 0xFE
+// ping), which neither signature continues with. A connection that closes
+// or times out before sending anything is left for the player path.
+func sniffProxyHeader(c net.Conn) ([]byte, bool, error) {
+	var seen []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			if len(seen) == 0 {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		seen = append(seen, b[0])
+		v1 := bytes.HasPrefix(proxyV1Sig, seen)
+		v2 := bytes.HasPrefix(proxyV2Sig, seen)
+		switch {
+		case !v1 && !v2:
+			return seen, false, nil
+		case v1 && len(seen) == len(proxyV1Sig), v2 && len(seen) == len(proxyV2Sig):
+			return seen, true, nil
+		}
+	}
+}
+
+// readProxyV1 parses "PROXY TCP4 src dst sport dport\r\n" after the "P".
+func readProxyV1(r io.Reader) (netip.AddrPort, error) {
+	line := []byte{'P'}
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return netip.AddrPort{}, fmt.Errorf("%w: v1 line too long", errBadProxyHeader)
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	if len(f) < 2 || f[0] != "PROXY" {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q", errBadProxyHeader, line)
+	}
+	if f[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if (f[1] != "TCP4" && f[1] != "TCP6") || len(f) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q", errBadProxyHeader, line)
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil || ip.Is4() != (f[1] == "TCP4") {
+		return netip.AddrPort{}, fmt.Errorf("%w: source address %q", errBadProxyHeader, f[2])
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: source port %q", errBadProxyHeader, f[4])
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// readProxyV2 parses the binary header after its first byte. TLVs after the
+// addresses are skipped.
+func readProxyV2(r io.Reader) (netip.AddrPort, error) {
+	var hdr [proxyV2Fixed]byte
+	hdr[0] = proxyV2Sig[0]
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return netip.AddrPort{}, fmt.Errorf("%w: bad v2 signature", errBadProxyHeader)
+	}
+	if hdr[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("%w: version %d", errBadProxyHeader, hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	switch hdr[12] & 0x0F {
+	case 0x0: // LOCAL: health check from the balancer itself
+		return netip.AddrPort{}, nil
+	case 0x1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w: command %d", errBadProxyHeader, hdr[12]&0x0F)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET: src(4) dst(4) sport dport
+		if len(body) < 12 {
+			return netip.AddrPort{}, fmt.Errorf("%w: short IPv4 addresses", errBadProxyHeader)
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:])), nil
+	case 0x2: // AF_INET6: src(16) dst(16) sport dport
+		if len(body) < 36 {
+			return netip.AddrPort{}, fmt.Errorf("%w: short IPv6 addresses", errBadProxyHeader)
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:])), nil
+	}
+	// AF_UNSPEC and AF_UNIX carry no usable client address.
+	return netip.AddrPort{}, nil
+}
+
+///////////////////////
+//  出口机：向目标发送 PROXY protocol 头
+///////////////////////
+
+// dialTargetFor is dialTarget followed by the -exit-proxy-protocol header,
+// naming player as the source and local, the exit address the upgrade came
+// in on, as the destination.
+func dialTargetFor(target, player string, local net.Addr) (net.Conn, error) {
+	c, err := dialTarget(target)
+	if err != nil || *exitProxyProtocol == "off" {
+		return c, err
+	}
+	dst := ""
+	if local != nil {
+		dst = local.String()
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(handshakeReadTimeout))
+	err = writeProxyHeader(c, *exitProxyProtocol, player, dst)
+	_ = c.SetWriteDeadline(time.Time{})
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("send PROXY header: %w", err)
+	}
+	return c, nil
+}
+
+// writeProxyHeader writes a version ("v1" or "v2") PROXY header for a
+// connection from src to dst. Either can be "ip:port" or a bare IP, as
+// clientAddr returns for a header-resolved client. If src is not an IP the
+// header says so (UNKNOWN in v1, LOCAL in v2) and the target keeps the
+// exit's own address. A dst that is not an IP, or of the other family, is
+// sent as the unspecified address of src's family, since a header carries
+// one family only.
+func writeProxyHeader(w io.Writer, version, src, dst string) error {
+	from, ok := parseHeaderAddr(src)
+	to, toOK := parseHeaderAddr(dst)
+	if ok && (!toOK || to.Addr().Is4() != from.Addr().Is4()) {
+		to = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		if from.Addr().Is4() {
+			to = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		}
+	}
+
+	var hdr []byte
+	if version == "v1" {
+		switch {
+		case !ok:
+			hdr = []byte("PROXY UNKNOWN\r\n")
+		case from.Addr().Is4():
+			hdr = fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", from.Addr(), to.Addr(), from.Port(), to.Port())
+		default:
+			hdr = fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", from.Addr(), to.Addr(), from.Port(), to.Port())
+		}
+		_, err := w.Write(hdr)
+		return err
+	}
+
+	hdr = append(hdr, proxyV2Sig...)
+	switch {
+	case !ok:
+		hdr = append(hdr, 0x20, 0x00, 0, 0) // LOCAL, AF_UNSPEC
+	case from.Addr().Is4():
+		hdr = append(hdr, 0x21, 0x11, 0, 12) // PROXY, AF_INET + STREAM
+		hdr = append(hdr, from.Addr().AsSlice()...)
+		hdr = append(hdr, to.Addr().AsSlice()...)
+	default:
+		hdr = append(hdr, 0x21, 0x21, 0, 36) // PROXY, AF_INET6 + STREAM
+		hdr = append(hdr, from.Addr().AsSlice()...)
+		hdr = append(hdr, to.Addr().AsSlice()...)
+	}
+	if ok {
+		hdr = binary.BigEndian.AppendUint16(hdr, from.Port())
+		hdr = binary.BigEndian.AppendUint16(hdr, to.Port())
+	}
+	_, err := w.Write(hdr)
+	return err
+}
+
+// parseHeaderAddr parses "ip:port" or a bare IP (port 0), unmapping
+// IPv4-in-IPv6 and dropping any zone.
+func parseHeaderAddr(s string) (netip.AddrPort, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port()), true
+	}
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(ip.Unmap().WithZone(""), 0), true
+	}
+	return netip.AddrPort{}, false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// handshakePacket is a Minecraft handshake for host, framed as it goes on
+// the wire.
+func handshakePacket(host string) []byte {
+	var body []byte
+	body = appendVarInt(body, 765)
+	body = appendString(body, host)
+	body = binary.BigEndian.AppendUint16(body, 25565)
+	body = appendVarInt(body, mcStateLogin)
+	var buf bytes.Buffer
+	_ = writePacket(&buf, 0, body)
+	return buf.Bytes()
+}
+
+// proxyV2Header is a v2 PROXY header for a TCP4 connection from src.
+func proxyV2Header(src [4]byte, port uint16) []byte {
+	h := append([]byte(nil), proxyV2Sig...)
+	h = append(h, 0x21, 0x11, 0, 12)
+	h = append(h, src[:]...)
+	h = append(h, 10, 0, 0, 1)
+	h = binary.BigEndian.AppendUint16(h, port)
+	h = binary.BigEndian.AppendUint16(h, 25565)
+	return h
+}
+
+func TestProxyProtocolAutoSniff(t *testing.T) {
+	setFlag(t, proxyProtocolMode, "auto")
+
+	handshake := handshakePacket("mc.example.com")
+	// Lengths that make the first byte look like the start of a signature.
+	looksV1 := handshakePacket(strings.Repeat("p", 0x50-7))
+	looksV2 := handshakePacket("a.b.cd")
+	if looksV1[0] != 'P' || looksV2[0] != '\r' {
+		t.Fatalf("handshakes start with %q and %q", looksV1[0], looksV2[0])
+	}
+	v1 := []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 25565\r\n")
+	v2 := proxyV2Header([4]byte{203, 0, 113, 7}, 51234)
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for _, tc := range []struct {
+		name   string
+		chunks [][]byte // written one at a time, with a pause between them
+		remote string   // "" for the pipe's own address
+		want   []byte   // what the player side reads after the header
+	}{
+		{"v1 header", [][]byte{cat(v1, handshake)}, "203.0.113.7:51234", handshake},
+		{"v1 header split", [][]byte{v1[:3], cat(v1[3:], handshake)}, "203.0.113.7:51234", handshake},
+		{"v2 header", [][]byte{cat(v2, handshake)}, "203.0.113.7:51234", handshake},
+		{"v2 signature split", [][]byte{v2[:5], v2[5:9], cat(v2[9:], handshake)}, "203.0.113.7:51234", handshake},
+		{"v1 unknown", [][]byte{cat([]byte("PROXY UNKNOWN\r\n"), handshake)}, "", handshake},
+		{"player", [][]byte{handshake}, "", handshake},
+		{"player starting with P", [][]byte{looksV1}, "", looksV1},
+		{"player starting with CR", [][]byte{looksV2}, "", looksV2},
+		{"player split after P", [][]byte{looksV1[:1], looksV1[1:]}, "", looksV1},
+		{"short first read", [][]byte{handshake[:1], handshake[1:2], handshake[2:]}, "", handshake},
+		{"legacy ping", [][]byte{{0xFE, 0x01, 0xFA}}, "", []byte{0xFE, 0x01, 0xFA}},
+		{"v1 signature that diverges", [][]byte{[]byte("PROX"), []byte("Z and more")}, "", []byte("PROXZ and more")},
+		{"v2 signature that diverges", [][]byte{v2[:6], {0x01, 0x02}}, "", cat(v2[:6], []byte{0x01, 0x02})},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				for i, chunk := range tc.chunks {
+					if i > 0 {
+						time.Sleep(10 * time.Millisecond)
+					}
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			c, err := acceptProxyHeader(server)
+			if err != nil {
+				t.Fatal("acceptProxyHeader:", err)
+			}
+			remote := tc.remote
+			if remote == "" {
+				remote = server.RemoteAddr().String()
+			}
+			if got := c.RemoteAddr().String(); got != remote {
+				t.Errorf("remote address %s, want %s", got, remote)
+			}
+			got, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal("read:", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("player side read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteProxyHeaderRoundTrip(t *testing.T) {
+	setFlag(t, proxyProtocolMode, "require")
+	for _, tc := range []struct {
+		version, src, dst string
+		want              string // "" when the header carries no client
+	}{
+		{"v1", "203.0.113.7:51234", "10.0.0.1:443", "203.0.113.7:51234"},
+		{"v2", "203.0.113.7:51234", "10.0.0.1:443", "203.0.113.7:51234"},
+		{"v1", "[2001:db8::7]:51234", "[2001:db8::1]:443", "[2001:db8::7]:51234"},
+		{"v2", "[2001:db8::7]:51234", "[2001:db8::1]:443", "[2001:db8::7]:51234"},
+		{"v2", "[::ffff:203.0.113.7]:51234", "10.0.0.1:443", "203.0.113.7:51234"},
+		{"v1", "203.0.113.7", "10.0.0.1:443", "203.0.113.7:0"}, // from X-Forwarded-For
+		{"v2", "203.0.113.7:51234", "[2001:db8::1]:443", "203.0.113.7:51234"},
+		{"v1", "[2001:db8::7]:51234", "", "[2001:db8::7]:51234"},
+		{"v1", "not an address", "10.0.0.1:443", ""},
+		{"v2", "not an address", "10.0.0.1:443", ""},
+	} {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, tc.version, tc.src, tc.dst); err != nil {
+			t.Fatal(err)
+		}
+		server, client := net.Pipe()
+		go func() {
+			client.Write(append(buf.Bytes(), "after"...))
+			client.Close()
+		}()
+		c, err := acceptProxyHeader(server)
+		if err != nil {
+			t.Errorf("%s %s -> %s: %v", tc.version, tc.src, tc.dst, err)
+			continue
+		}
+		want := tc.want
+		if want == "" {
+			want = server.RemoteAddr().String()
+		}
+		if got := c.RemoteAddr().String(); got != want {
+			t.Errorf("%s %s -> %s: parsed as %s, want %s", tc.version, tc.src, tc.dst, got, want)
+		}
+		if rest, _ := io.ReadAll(c); string(rest) != "after" {
+			t.Errorf("%s %s -> %s: header was %d bytes, not all consumed", tc.version, tc.src, tc.dst, buf.Len())
+		}
+		server.Close()
+	}
+}
+
+func TestExitSendsResolvedClient(t *testing.T) {
+	setFlag(t, exitProxyProtocol, "v1")
+	setFlag(t, proxyProtocolMode, "require")
+	setFlag(t, trustedProxies, "127.0.0.1")
+	loadTrustedProxies()
+	t.Cleanup(func() { trustedNets = nil })
+
+	url, targets := startPipeExit(t)
+
+	// A spoofed hop to the left of what the trusted proxy appended.
+	h := http.Header{"X-Forwarded-For": {"192.0.2.66, 203.0.113.7"}}
+	ws, _, err := websocket.DefaultDialer.Dial(url, h)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	defer ws.Close()
+
+	target := <-targets
+	c, err := acceptProxyHeader(target)
+	if err != nil {
+		t.Fatal("target read PROXY header:", err)
+	}
+	if got := c.RemoteAddr().String(); got != "203.0.113.7:0" {
+		t.Errorf("PROXY header names %s, want the resolved client 203.0.113.7", got)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"mc-ws-proxy/proxy"
+)
+
+var targetReconnectWindow = flag.Duration("target-reconnect-window", 0, "on the exit, keep the WebSocket open and redial the TCP target for up to this long after it drops the connection (0 = disabled; not for Minecraft, see README)")
+
+// targetRedialBackoff is the pause between redial attempts.
+const targetRedialBackoff = 500 * time.Millisecond
+
+// redialConn is the exit's TCP target connection with -target-reconnect-window:
+// when the target drops the connection (EOF, reset, write error) it dials
+// again for up to window and carries on with the new connection. While it
+// is redialing, the write in progress is held and the rest of the inbound WS
+// data waits behind it; the chunk being written is resent in full.
+//
+// Deadlines set through redialConn are remembered and applied to each new
+// connection. Close stops a redial in progress.
+type redialConn struct {
+	dial   func() (net.Conn, error)
+	window time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	rd, wd time.Time
+	redial chan struct{} // non-nil while a redial is in progress, closed when it ends
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRedialConn(c net.Conn, dial func() (net.Conn, error), window time.Duration) *redialConn {
+	return &redialConn{dial: dial, window: window, conn: c, closed: make(chan struct{})}
+}
+
+func (r *redialConn) current() net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+func (r *redialConn) Read(p []byte) (int, error) {
+	for {
+		c := r.current()
+		n, err := c.Read(p)
+		if err == nil || !r.lost(err) {
+			return n, err
+		}
+		if n > 0 {
+			// Hand out what we got; the next Read will see the error again.
+			return n, nil
+		}
+		if !r.reconnect(c, err) {
+			return n, err
+		}
+	}
+}
+
+func (r *redialConn) Write(p []byte) (int, error) {
+	for {
+		c := r.current()
+		n, err := c.Write(p)
+		if err == nil || !r.lost(err) {
+			return n, err
+		}
+		if !r.reconnect(c, err) {
+			return n, err
+		}
+	}
+}
+
+// lost reports whether err means the target went away, as opposed to one of
+// our own deadlines firing or the bridge closing the connection.
+func (r *redialConn) lost(err error) bool {
+	select {
+	case <-r.closed:
+		return false
+	default:
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return false
+	}
+	return !errors.Is(err, net.ErrClosed)
+}
+
+// reconnect replaces old with a fresh connection to the target. Concurrent
+// callers (reader and writer both noticing the drop) share one redial.
+func (r *redialConn) reconnect(old net.Conn, cause error) bool {
+	r.mu.Lock()
+	if r.conn != old {
+		r.mu.Unlock()
+		return true
+	}
+	if ch := r.redial; ch != nil {
+		r.mu.Unlock()
+		select {
+		case <-ch:
+		case <-r.closed:
+			return false
+		}
+		return r.current() != old
+	}
+	ch := make(chan struct{})
+	r.redial = ch
+	r.mu.Unlock()
+
+	log.Println("[EXIT] Lost TCP target, redialing:", cause)
+	_ = old.Close()
+	nc := r.redialLoop()
+
+	r.mu.Lock()
+	r.redial = nil
+	if nc != nil {
+		r.conn = nc
+		_ = nc.SetReadDeadline(r.rd)
+		_ = nc.SetWriteDeadline(r.wd)
+	}
+	r.mu.Unlock()
+	close(ch)
+
+	if nc == nil {
+		log.Println("[EXIT] TCP target still down after", r.window)
+		return false
+	}
+	log.Println("[EXIT] Reconnected to TCP target", nc.RemoteAddr())
+	return true
+}
+
+func (r *redialConn) redialLoop() net.Conn {
+	deadline := time.Now().Add(r.window)
+	for {
+		c, err := r.dial()
+		if err == nil {
+			return c
+		}
+		if *debug {
+			log.Println("[EXIT] Redial TCP target", dialErrKind(err)+":", err)
+		}
+		wait := min(targetRedialBackoff, time.Until(deadline))
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.closed:
+			return nil
+		}
+	}
+}
+
+func (r *redialConn) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.current().Close()
+}
+
+func (r *redialConn) CloseWrite() error {
+	if cw, ok := r.current().(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (r *redialConn) LocalAddr() net.Addr  { return r.current().LocalAddr() }
+func (r *redialConn) RemoteAddr() net.Addr { return r.current().RemoteAddr() }
+
+func (r *redialConn) SetDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rd, r.wd = t, t
+	return r.conn.SetDeadline(t)
+}
+
+func (r *redialConn) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rd = t
+	return r.conn.SetReadDeadline(t)
+}
+
+func (r *redialConn) SetWriteDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wd = t
+	return r.conn.SetWriteDeadline(t)
+}
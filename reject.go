@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// rejectReason says why a connection never got to the bridge. Each reason
+// has a counter, served on the admin /metrics endpoint.
+type rejectReason int
+
+const (
+	rejectUpgrade       rejectReason = iota // exit: WebSocket upgrade failed
+	rejectTargetDial                        // exit: could not dial -exit-target
+	rejectAuth                              // exit: Basic auth failed
+	rejectLimit                             // a mode this side does not allow, or over a limit
+	rejectProxyHello                        // exit: missing or bad -proxy-hello
+	rejectBackendDial                       // entry: could not dial -ws
+	rejectUsername                          // entry: username refused by the lists
+	rejectHandshake                         // entry: unparsable handshake with filtering on
+	rejectTargetDenied                      // exit: -exit-target not in -target-allowlist
+	rejectProxyProtocol                     // entry: missing or malformed PROXY protocol header
+	rejectLoop                              // upgrade or player connection that came from this process
+	rejectProtocol                          // entry: protocol version outside -min-protocol/-max-protocol
+	rejectCountry                           // entry: player's country refused by -blocked-countries/-allowed-countries
+	rejectEntrySource                       // exit: upgrade from outside -expected-entry-cidrs with -expected-entry-strict
+	rejectListenTLS                         // entry: player's TLS handshake failed with -listen-tls-cert
+	rejectDraining                          // new connection while draining (SIGUSR1)
+	numRejectReasons
+)
+
+var rejectReasonNames = [numRejectReasons]string{
+	rejectUpgrade:       "upgrade",
+	rejectTargetDial:    "target_dial",
+	rejectAuth:          "auth",
+	rejectLimit:         "limit",
+	rejectProxyHello:    "proxy_hello",
+	rejectBackendDial:   "backend_dial",
+	rejectUsername:      "username",
+	rejectHandshake:     "handshake",
+	rejectTargetDenied:  "target_denied",
+	rejectProxyProtocol: "proxy_protocol",
+	rejectLoop:          "loop",
+	rejectProtocol:      "protocol",
+	rejectCountry:       "country",
+	rejectEntrySource:   "entry_source",
+	rejectListenTLS:     "listen_tls",
+	rejectDraining:      "draining",
+}
+
+func (r rejectReason) String() string { return rejectReasonNames[r] }
+
+var rejectCounts [numRejectReasons]atomic.Int64
+
+// reject counts a connection turned away for reason and logs msg with it.
+// Callers return right after.
+func reject(reason rejectReason, tag string, msg ...any) {
+	rejectCounts[reason].Add(1)
+	log.Println(append([]any{tag, "reject " + reason.String() + ":"}, msg...)...)
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	connRegistry.Lock()
+	n := len(connRegistry.conns)
+	connRegistry.Unlock()
+	il := fmt.Sprintf("instance_label=%q", metricsInstance)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP mcwsproxy_rejects_total Connections turned away before bridging, by reason.")
+	fmt.Fprintln(w, "# TYPE mcwsproxy_rejects_total counter")
+	for i := range rejectCounts {
+		fmt.Fprintf(w, "mcwsproxy_rejects_total{%s,reason=%q} %d\n", il, rejectReason(i), rejectCounts[i].Load())
+	}
+	fmt.Fprintln(w, "# HELP mcwsproxy_connections Connections currently being bridged.")
+	fmt.Fprintln(w, "# TYPE mcwsproxy_connections gauge")
+	fmt.Fprintf(w, "mcwsproxy_connections{%s} %d\n", il, n)
+	if *mode == "entry" {
+		fmt.Fprintln(w, "# HELP mcwsproxy_dial_aborted_total WebSocket dials given up because the player disconnected before they finished (-abort-dial-on-close).")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_dial_aborted_total counter")
+		fmt.Fprintf(w, "mcwsproxy_dial_aborted_total{%s} %d\n", il, abortedDials.Load())
+		fmt.Fprintln(w, "# HELP mcwsproxy_backend_healthy Whether the circuit breaker lets new connections through to a -ws backend.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_backend_healthy gauge")
+		status := backendStatus()
+		for _, b := range status {
+			fmt.Fprintf(w, "mcwsproxy_backend_healthy{%s,backend=%q} %d\n", il, b.URL, boolMetric(b.Healthy))
+		}
+		fmt.Fprintln(w, "# HELP mcwsproxy_backend_draining Whether a -ws backend is drained through the admin API and skipped by new connections.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_backend_draining gauge")
+		for _, b := range status {
+			fmt.Fprintf(w, "mcwsproxy_backend_draining{%s,backend=%q} %d\n", il, b.URL, boolMetric(b.Draining))
+		}
+		fmt.Fprintln(w, "# HELP mcwsproxy_backend_connections Connections currently bridged to a -ws backend.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_backend_connections gauge")
+		for _, b := range status {
+			fmt.Fprintf(w, "mcwsproxy_backend_connections{%s,backend=%q} %d\n", il, b.URL, b.Connections)
+		}
+	}
+	if *mode == "entry" && *wsPoolSize > 0 {
+		fmt.Fprintln(w, "# HELP mcwsproxy_ws_pool_idle Pre-dialed WebSocket connections waiting for a player.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_ws_pool_idle gauge")
+		fmt.Fprintf(w, "mcwsproxy_ws_pool_idle{%s} %d\n", il, entryPool.size())
+		fmt.Fprintln(w, "# HELP mcwsproxy_ws_pool_misses_total Players who found -ws-pool-size empty and dialed the backend themselves.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_ws_pool_misses_total counter")
+		fmt.Fprintf(w, "mcwsproxy_ws_pool_misses_total{%s} %d\n", il, entryPool.misses.Load())
+	}
+	if *maxConnMemory > 0 {
+		fmt.Fprintln(w, "# HELP mcwsproxy_memory_limit_closes_total Connections closed because a WebSocket message did not fit in -max-conn-memory.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_memory_limit_closes_total counter")
+		fmt.Fprintf(w, "mcwsproxy_memory_limit_closes_total{%s} %d\n", il, memoryLimitCloses.Load())
+	}
+	fmt.Fprintln(w, "# HELP mcwsproxy_reassembly_bytes Bytes of WebSocket messages read whole and not yet written to TCP, all connections together.")
+	fmt.Fprintln(w, "# TYPE mcwsproxy_reassembly_bytes gauge")
+	fmt.Fprintf(w, "mcwsproxy_reassembly_bytes{%s} %d\n", il, globalReassembly.InUse())
+	if *maxTotalReassembly > 0 {
+		fmt.Fprintln(w, "# HELP mcwsproxy_reassembly_limit_closes_total Connections closed because a large WebSocket message arrived while -max-total-reassembly was reached.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_reassembly_limit_closes_total counter")
+		fmt.Fprintf(w, "mcwsproxy_reassembly_limit_closes_total{%s} %d\n", il, reassemblyLimitCloses.Load())
+	}
+	if *mode == "entry" && *countAfterHandshake {
+		fmt.Fprintln(w, "# HELP mcwsproxy_probe_connections_total Connections closed by -count-after-handshake because they sent no valid Minecraft handshake.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_probe_connections_total counter")
+		fmt.Fprintf(w, "mcwsproxy_probe_connections_total{%s} %d\n", il, probeConns.Load())
+	}
+	if *mode == "entry" && *statusCacheTTL > 0 {
+		fmt.Fprintln(w, "# HELP mcwsproxy_status_cache_total Server list pings answered from -status-cache-ttl (hit) or passed to the backend (miss).")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_status_cache_total counter")
+		fmt.Fprintf(w, "mcwsproxy_status_cache_total{%s,result=\"hit\"} %d\n", il, statusCacheHits.Load())
+		fmt.Fprintf(w, "mcwsproxy_status_cache_total{%s,result=\"miss\"} %d\n", il, statusCacheMisses.Load())
+	}
+	if *e2eRTT {
+		fmt.Fprintln(w, "# HELP mcwsproxy_e2e_rtt_seconds WebSocket round trips measured by -e2e-rtt, all connections together.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_e2e_rtt_seconds summary")
+		fmt.Fprintf(w, "mcwsproxy_e2e_rtt_seconds_sum{%s} %g\n", il, time.Duration(rttSum.Load()).Seconds())
+		fmt.Fprintf(w, "mcwsproxy_e2e_rtt_seconds_count{%s} %d\n", il, rttCount.Load())
+	}
+	if *webhookURL != "" {
+		fmt.Fprintln(w, "# HELP mcwsproxy_webhook_dropped_total Connection events not sent to -webhook-url because its queue was full.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_webhook_dropped_total counter")
+		fmt.Fprintf(w, "mcwsproxy_webhook_dropped_total{%s} %d\n", il, webhookDrops.Load())
+	}
+	if *mirrorWS != "" {
+		fmt.Fprintln(w, "# HELP mcwsproxy_mirror_dropped_total Chunks not copied to -mirror-ws because it was slow or down.")
+		fmt.Fprintln(w, "# TYPE mcwsproxy_mirror_dropped_total counter")
+		fmt.Fprintf(w, "mcwsproxy_mirror_dropped_total{%s} %d\n", il, mirrorDrops.Load())
+	}
+}
+
+func boolMetric(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
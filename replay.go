@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	replayFile   = flag.String("replay", "", "replay the client->server data of this -capture-file against -ws through the entry dial path, then exit (non-zero if a connection could not be dialed)")
+	replaySpeed  = flag.Float64("replay-speed", 1, "with -replay, 1 keeps the original timing, 2 plays twice as fast, 0 sends everything as fast as possible")
+	replayConn   = flag.Uint64("replay-conn", 0, "with -replay, only replay this connection ID from the file (0 = all of them, concurrently, at their original offsets)")
+	replaySide   = flag.String("replay-side", "entry", "with -replay, which side wrote the capture file: entry (client->server records are the TCP reads) or exit (they are the WebSocket frames)")
+	replayLinger = flag.Duration("replay-linger", 2*time.Second, "with -replay, how long to keep each connection open for replies after its last record")
+)
+
+///////////////////////
+//  回放抓包文件（-replay）
+///////////////////////
+
+// replayAddr stands in for the player in -proxy-hello and the logs.
+var replayAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// runReplay plays the client's side of each captured connection into a
+// pipe bridged to a freshly dialed backend, exactly as if a player sent the
+// bytes, and reports what came back.
+func runReplay() int {
+	if *replaySpeed < 0 {
+		log.Fatalf("-replay-speed must not be negative, got %v", *replaySpeed)
+	}
+	fromClient := byte(captureToWS)
+	switch *replaySide {
+	case "entry":
+	case "exit":
+		fromClient = captureToTCP
+	default:
+		log.Fatalf("unknown -replay-side: %s (must be entry or exit)", *replaySide)
+	}
+
+	recs, err := readCapture(*replayFile)
+	if err != nil {
+		log.Fatal("[REPLAY] ", err)
+	}
+	conns := make(map[uint64]*replayConnRecs)
+	for _, r := range recs {
+		if *replayConn != 0 && r.ConnID != *replayConn {
+			continue
+		}
+		c := conns[r.ConnID]
+		if c == nil {
+			c = &replayConnRecs{id: r.ConnID, first: r.Time}
+			conns[r.ConnID] = c
+		}
+		if r.Dir == fromClient {
+			c.sent = append(c.sent, r)
+		} else {
+			c.recorded += len(r.Data)
+		}
+	}
+	if len(conns) == 0 {
+		log.Println("[REPLAY] No matching connections in", *replayFile)
+		return 1
+	}
+	list := make([]*replayConnRecs, 0, len(conns))
+	for _, c := range conns {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].first < list[j].first })
+	log.Printf("[REPLAY] Replaying %d connection(s) from %s", len(list), *replayFile)
+
+	start, t0 := time.Now(), list[0].first
+	var failed atomic.Int32
+	var wg sync.WaitGroup
+	for _, c := range list {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sleepUntil(start, c.first-t0)
+			if err := c.replay(start, t0); err != nil {
+				log.Printf("[REPLAY] conn %d: %v", c.id, err)
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		log.Printf("[REPLAY] %d of %d connections failed", n, len(list))
+		return 1
+	}
+	log.Println("[REPLAY] Done")
+	return 0
+}
+
+// replayConnRecs is one captured connection: the records to send and the
+// byte count the other direction had in the capture.
+type replayConnRecs struct {
+	id       uint64
+	first    int64 // time of its first record
+	sent     []captureRec
+	recorded int
+}
+
+// sleepUntil waits until offset (in capture time) has passed since start,
+// scaled by -replay-speed.
+func sleepUntil(start time.Time, offset int64) {
+	if *replaySpeed == 0 {
+		return
+	}
+	at := start.Add(time.Duration(float64(offset) / *replaySpeed))
+	if d := time.Until(at); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *replayConnRecs) replay(start time.Time, t0 int64) error {
+	ws, backendURL, err := dialPlayerBackend(context.Background(), replayAddr, nil)
+	if err != nil {
+		return fmt.Errorf("dial WS backend %s: %w", dialErrKind(err), err)
+	}
+	defer ws.Close()
+
+	player, bridged := net.Pipe()
+	info := newConnInfo("entry", replayAddr.String(), backendURL)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = bridgeTCPAndWS(context.Background(), bridged, ws, info, "[REPLAY]")
+		_ = bridged.Close()
+	}()
+	go func() { _, _ = io.Copy(io.Discard, player) }()
+
+	sent := 0
+	for _, r := range c.sent {
+		sleepUntil(start, r.Time-t0)
+		if _, err := player.Write(r.Data); err != nil {
+			break
+		}
+		sent += len(r.Data)
+	}
+	select {
+	case <-time.After(*replayLinger):
+	case <-done:
+	}
+	_ = player.Close()
+	<-done
+
+	log.Printf("[REPLAY] conn %d: sent %d bytes in %d records to %s, got %d bytes back (%d in the capture)",
+		c.id, sent, len(c.sent), backendURL, info.Counters.ToTCP.Load(), c.recorded)
+	return nil
+}
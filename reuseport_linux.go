@@ -0,0 +1,7 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package main
+
+// soReusePort is SO_REUSEPORT, which the frozen syscall package does not
+// define for Linux. The value is the same on all architectures listed above.
+const soReusePort = 0xf
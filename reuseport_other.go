@@ -0,0 +1,12 @@
+//go:build !((linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)) || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "syscall"
+
+// setReusePort does nothing here: the platform has no SO_REUSEPORT.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+const reusePortSupported = false
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var (
+	rootResponse     = flag.String("root-response", "", "on the exit, answer GET / with this body instead of 404, for browsers and uptime checks that expect a page there")
+	rootResponseFile = flag.String("root-response-file", "", "like -root-response, with the body read from this file at startup")
+	rootStatus       = flag.Int("root-status", http.StatusOK, "HTTP status for -root-response")
+	rootContentType  = flag.String("root-content-type", "text/plain; charset=utf-8", "Content-Type for -root-response")
+)
+
+///////////////////////
+//  出口机：根路径页面
+///////////////////////
+
+// rootBody is the loaded -root-response; nil leaves / to 404.
+var rootBody []byte
+
+func loadRootResponse() error {
+	switch {
+	case *rootResponse != "" && *rootResponseFile != "":
+		return fmt.Errorf("-root-response and -root-response-file are mutually exclusive")
+	case *rootResponse != "":
+		rootBody = []byte(*rootResponse)
+	case *rootResponseFile != "":
+		b, err := os.ReadFile(*rootResponseFile)
+		if err != nil {
+			return fmt.Errorf("-root-response-file: %w", err)
+		}
+		rootBody = b
+	}
+	if rootBody != nil && (*rootStatus < 100 || *rootStatus > 999) {
+		return fmt.Errorf("-root-status must be an HTTP status code, got %d", *rootStatus)
+	}
+	return nil
+}
+
+// handleRoot serves -root-response on / only; every other unknown path
+// still gets a 404, and /ws has its own handler.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", *rootContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(rootBody)))
+	w.WriteHeader(*rootStatus)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(rootBody)
+	}
+}
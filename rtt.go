@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+var e2eRTT = flag.Bool("e2e-rtt", false, "stamp each -ping-interval ping with the time it was sent and measure the round trip from the pong the other proxy (or anything WebSocket-compliant) echoes back; shown in the admin API and /metrics")
+
+///////////////////////
+//  端到端往返时间（-e2e-rtt）
+///////////////////////
+
+// rttSum and rttCount add up every round trip measured, for the summary in
+// /metrics.
+var (
+	rttSum   atomic.Int64 // nanoseconds
+	rttCount atomic.Uint64
+)
+
+// recordRTT is the bridge's OnRTT for info.
+func recordRTT(info *connInfo, tag string) func(time.Duration) {
+	return func(rtt time.Duration) {
+		info.rtt.Store(int64(rtt))
+		rttSum.Add(int64(rtt))
+		rttCount.Add(1)
+		if *debug {
+			log.Printf("%s conn %d WS round trip %s", tag, info.ID, rtt.Round(time.Microsecond))
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// listenFunc and dialFunc open every listener (-listen, -exit-listen,
+// -admin, TCP or Unix) and every outgoing connection (to the -ws backends,
+// -mirror-ws and the exit's target), and wsDialFunc runs every WebSocket
+// handshake the entry makes on top of them. They exist so an end-to-end
+// test can put the whole proxy on an in-memory network, e.g. one built from
+// net.Pipe, without binding ports; nothing else replaces them. Webhook and
+// Sentry reports are plain HTTP clients and do not go through them.
+var (
+	listenFunc = func(ctx context.Context, lc *net.ListenConfig, network, address string) (net.Listener, error) {
+		return lc.Listen(ctx, network, address)
+	}
+	dialFunc = func(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}
+	wsDialFunc = func(ctx context.Context, d *websocket.Dialer, url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		return d.DialContext(ctx, url, header)
+	}
+)
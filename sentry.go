@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mc-ws-proxy/proxy"
+)
+
+var sentryDSN = flag.String("sentry-dsn", "", "report unusual bridge errors (not clean EOFs or normal closes) to the Sentry project with this DSN")
+
+///////////////////////
+//  错误上报（-sentry-dsn）
+///////////////////////
+
+// A minimal client for Sentry's envelope endpoint; reporting one event
+// type does not warrant the SDK.
+
+const (
+	sentryQueueSize   = 64
+	sentrySendTimeout = 10 * time.Second
+)
+
+type sentryClient struct {
+	endpoint string
+	auth     string
+	dsn      string
+	server   string
+	queue    chan []byte
+}
+
+// sentry is nil unless -sentry-dsn is set.
+var sentry *sentryClient
+
+func initSentry() error {
+	if *sentryDSN == "" {
+		return nil
+	}
+	c, err := newSentryClient(*sentryDSN)
+	if err != nil {
+		return err
+	}
+	sentry = c
+	go sentry.run()
+	log.Println("Reporting bridge errors to Sentry at", c.endpoint)
+	return nil
+}
+
+// newSentryClient parses dsn into the client's envelope endpoint and auth
+// header. It does not start run.
+func newSentryClient(dsn string) (*sentryClient, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("-sentry-dsn: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("-sentry-dsn must be an http or https URL, got %q", u.Scheme)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || i < 0 || u.Path[i+1:] == "" {
+		return nil, fmt.Errorf("-sentry-dsn must look like https://KEY@HOST/PROJECT_ID")
+	}
+	base, project := u.Path[:i], u.Path[i+1:]
+	host, _ := os.Hostname()
+	return &sentryClient{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, base, project),
+		auth:     "Sentry sentry_version=7, sentry_client=mc-ws-proxy/1, sentry_key=" + u.User.Username(),
+		dsn:      dsn,
+		server:   host,
+		queue:    make(chan []byte, sentryQueueSize),
+	}, nil
+}
+
+// reportBridgeError sends err to Sentry unless it is an ordinary way for a
+// connection to end.
+func reportBridgeError(err error, info *connInfo) {
+	if sentry == nil || !unusualBridgeError(err) {
+		return
+	}
+	sentry.report(err, info)
+}
+
+// report queues err as an event for run to send. When the queue is full
+// the event is dropped.
+func (c *sentryClient) report(err error, info *connInfo) {
+	var raw [16]byte
+	_, _ = rand.Read(raw[:])
+	id := hex.EncodeToString(raw[:])
+	event := map[string]any{
+		"event_id":    id,
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      "bridge",
+		"server_name": c.server,
+		"message":     map[string]string{"formatted": err.Error()},
+		"exception": map[string]any{"values": []map[string]string{{
+			"type":  info.Mode + " bridge error",
+			"value": err.Error(),
+		}}},
+		"tags": map[string]string{
+			"mode":           info.Mode,
+			"conn_id":        strconv.FormatUint(info.ID, 10),
+			"remote":         info.Remote,
+			"instance":       instanceID,
+			"instance_label": metricsInstance,
+		},
+		"extra": map[string]any{
+			"backend":  info.Backend,
+			"duration": time.Since(info.Start).String(),
+		},
+	}
+	body, _ := json.Marshal(event)
+	header, _ := json.Marshal(map[string]string{"event_id": id, "dsn": c.dsn})
+
+	var env bytes.Buffer
+	env.Write(header)
+	env.WriteString("\n{\"type\":\"event\"}\n")
+	env.Write(body)
+	env.WriteString("\n")
+	select {
+	case c.queue <- env.Bytes():
+	default:
+		if *debug {
+			log.Println("Sentry queue full, dropping event for conn", info.ID)
+		}
+	}
+}
+
+// unusualBridgeError reports whether err is worth an error report. A
+// failed first write is retried by the entry and not reported either.
+func unusualBridgeError(err error) bool {
+	var fwErr *proxy.FirstWriteError
+	return !proxy.ExpectedClose(err) && !errors.As(err, &fwErr)
+}
+
+func (c *sentryClient) run() {
+	client := &http.Client{Timeout: sentrySendTimeout}
+	for env := range c.queue {
+		req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(env))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/x-sentry-envelope")
+		req.Header.Set("X-Sentry-Auth", c.auth)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Println("Sentry report:", err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Println("Sentry report:", resp.Status)
+		}
+	}
+}
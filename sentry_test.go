@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSentryDSN(t *testing.T) {
+	for dsn, ok := range map[string]bool{
+		"https://key@o0.ingest.sentry.io/123": true,
+		"http://key@sentry.internal/base/7":   true,
+		"ftp://key@sentry.internal/7":         false,
+		"https://o0.ingest.sentry.io/123":     false, // no key
+		"https://key@o0.ingest.sentry.io/":    false, // no project
+		"sentry.internal/7":                   false,
+	} {
+		_, err := newSentryClient(dsn)
+		if (err == nil) != ok {
+			t.Errorf("-sentry-dsn %s: %v, want ok=%v", dsn, err, ok)
+		}
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	type request struct {
+		path, auth string
+		body       []byte
+	}
+	got := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- request{r.URL.Path, r.Header.Get("X-Sentry-Auth"), body}
+	}))
+	defer srv.Close()
+
+	dsn := strings.Replace(srv.URL, "://", "://pubkey@", 1) + "/base/42"
+	c, err := newSentryClient(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.run()
+	defer close(c.queue)
+
+	info := newConnInfo("exit", "203.0.113.7:51234", "mc.test:25565")
+	c.report(errors.New("[EXIT] WS read: boom"), info)
+	var req request
+	select {
+	case req = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report arrived")
+	}
+
+	if req.path != "/base/api/42/envelope/" {
+		t.Errorf("posted to %s", req.path)
+	}
+	if !strings.Contains(req.auth, "sentry_version=7") || !strings.Contains(req.auth, "sentry_key=pubkey") {
+		t.Errorf("X-Sentry-Auth: %s", req.auth)
+	}
+
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(string(req.body)))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if len(lines) != 3 {
+		t.Fatalf("envelope has %d lines, want header, item header and event:\n%s", len(lines), req.body)
+	}
+	var header struct{ EventID, DSN string }
+	var item struct{ Type string }
+	var event struct {
+		EventID string            `json:"event_id"`
+		Tags    map[string]string `json:"tags"`
+		Message struct{ Formatted string }
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.DSN != dsn {
+		t.Errorf("envelope header %s (%v)", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &item); err != nil || item.Type != "event" {
+		t.Errorf("item header %s (%v)", lines[1], err)
+	}
+	if err := json.Unmarshal([]byte(lines[2]), &event); err != nil {
+		t.Fatalf("event %s: %v", lines[2], err)
+	}
+	if event.EventID == "" || !strings.Contains(lines[0], event.EventID) {
+		t.Errorf("event ID %q does not match the envelope header %s", event.EventID, lines[0])
+	}
+	if event.Message.Formatted != "[EXIT] WS read: boom" {
+		t.Errorf("message %q", event.Message.Formatted)
+	}
+	for tag, want := range map[string]string{
+		"mode":    "exit",
+		"conn_id": strconv.FormatUint(info.ID, 10),
+		"remote":  "203.0.113.7:51234",
+	} {
+		if event.Tags[tag] != want {
+			t.Errorf("tag %s = %q, want %q", tag, event.Tags[tag], want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"time"
+)
+
+var statsChannel = flag.Bool("stats-channel", false, "exit: send per-connection stats to the entry as WebSocket text frames; entry: record them (shown in the admin API). Text frames never reach TCP")
+
+const statsInterval = 30 * time.Second
+
+// peerStats is the JSON carried in stats text frames, as seen by the exit.
+type peerStats struct {
+	BytesToWS     int64   `json:"bytes_to_ws"`
+	BytesToTCP    int64   `json:"bytes_to_tcp"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Connections   int     `json:"connections"`
+}
+
+// statsFrame is the text frame the exit sends every statsInterval. Text
+// frames are ignored by entries without -stats-channel, so older entries
+// are fine.
+func statsFrame(info *connInfo) []byte {
+	connRegistry.Lock()
+	n := len(connRegistry.conns)
+	connRegistry.Unlock()
+	msg, _ := json.Marshal(peerStats{
+		BytesToWS:     info.ToWS.Load(),
+		BytesToTCP:    info.ToTCP.Load(),
+		UptimeSeconds: time.Since(info.Start).Seconds(),
+		Connections:   n,
+	})
+	return msg
+}
+
+// handleStatsFrame records a stats frame received by the entry. Frames
+// that are not valid stats are dropped.
+func handleStatsFrame(info *connInfo, data []byte, tag string) {
+	var st peerStats
+	if err := json.Unmarshal(data, &st); err != nil {
+		if *debug {
+			log.Printf("%s bad stats frame: %v", tag, err)
+		}
+		return
+	}
+	info.peerStats.Store(&st)
+	if *debug {
+		log.Printf("%s exit stats: %s", tag, data)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var statusCacheTTL = flag.Duration("status-cache-ttl", 0, "on the entry, remember each -ws backend's latest server list status for this long and answer status pings from it without dialing (0 = off; turns on handshake parsing)")
+
+///////////////////////
+//  入口机：服务器列表状态缓存
+///////////////////////
+
+// statusCacheMax bounds the status response the entry keeps; with a
+// favicon it is a few tens of KB.
+const statusCacheMax = 256 * 1024
+
+// cachedStatus is a backend's last status response, for the server
+// address the player asked for (virtual hosts may answer differently).
+type cachedStatus struct {
+	host string
+	json []byte
+	at   time.Time
+}
+
+var statusCacheHits, statusCacheMisses atomic.Uint64
+
+// cachedStatusFor returns a fresh status for hello from the first backend
+// that is usable and has one, or nil.
+func cachedStatusFor(hello *clientHello) []byte {
+	now := time.Now()
+	for _, b := range backends {
+		st := b.status.Load()
+		if st == nil || now.Sub(st.at) > *statusCacheTTL || !strings.EqualFold(st.host, hello.ServerAddress) || !b.usable(now) {
+			continue
+		}
+		return st.json
+	}
+	return nil
+}
+
+// statusSniffer watches the bytes a status ping's bridge writes to the
+// player for the Status Response packet and stores it on the backend.
+type statusSniffer struct {
+	host string
+	info *connInfo // for the backend the ping went to
+	buf  []byte
+	done bool
+}
+
+// tap is a proxy.Config Capture hook. The response is the first packet
+// the backend sends in status state, uncompressed.
+func (s *statusSniffer) tap(toTCP bool, data []byte) {
+	if !toTCP || s.done {
+		return
+	}
+	s.buf = append(s.buf, data...)
+	pr := &byteBuf{b: s.buf}
+	length, err := readVarInt(pr)
+	if err != nil {
+		s.done = len(s.buf) > 5
+		return
+	}
+	if length <= 0 || length > statusCacheMax {
+		s.done = true
+		return
+	}
+	if len(pr.b) < int(length) {
+		return // wait for the rest
+	}
+	s.done = true
+	body := &byteBuf{b: pr.b[:length]}
+	if id, err := readVarInt(body); err != nil || id != 0x00 {
+		return
+	}
+	json, err := readString(body, statusCacheMax)
+	if err != nil {
+		return
+	}
+	if b := findBackend(s.info.Backend); b != nil {
+		b.status.Store(&cachedStatus{host: s.host, json: []byte(json), at: time.Now()})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+///////////////////////
+//  退出时的汇总统计
+///////////////////////
+
+// processStart is when the process started, for the uptime in the summary.
+var processStart = time.Now()
+
+// Process-wide totals, guarded by connRegistry's lock. Bytes of a
+// connection are added when it unregisters; bytes of the ones still open
+// are added up when the summary is printed.
+var connTotals struct {
+	served      uint64
+	peak        int
+	toWS, toTCP int64
+}
+
+// countRegistered and countUnregistered are called by registerConn and
+// unregisterConn with connRegistry locked. A connection registered again
+// (a first-write retry over a new WebSocket) is served only once.
+func countRegistered(c *connInfo) {
+	if !c.counted {
+		c.counted = true
+		connTotals.served++
+	}
+	connTotals.peak = max(connTotals.peak, len(connRegistry.conns))
+}
+
+func countUnregistered(c *connInfo) {
+	ws, tcp := c.ToWS.Load(), c.ToTCP.Load()
+	connTotals.toWS += ws - c.countedWS
+	connTotals.toTCP += tcp - c.countedTCP
+	c.countedWS, c.countedTCP = ws, tcp
+}
+
+// logSummary logs the totals since the process started.
+func logSummary(why string) {
+	connRegistry.Lock()
+	toWS, toTCP := connTotals.toWS, connTotals.toTCP
+	for _, c := range connRegistry.conns {
+		toWS += c.ToWS.Load() - c.countedWS
+		toTCP += c.ToTCP.Load() - c.countedTCP
+	}
+	served, peak, open := connTotals.served, connTotals.peak, len(connRegistry.conns)
+	connRegistry.Unlock()
+
+	log.Printf("Exiting (%s) after %s: %d connections served, %d still open, peak %d concurrent; %d bytes to WS, %d bytes to TCP",
+		why, time.Since(processStart).Round(time.Second), served, open, peak, toWS, toTCP)
+}
+
+// watchExitSignals logs the summary on SIGINT or SIGTERM and exits with
+// the usual 128+signal status.
+func watchExitSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		logSummary(fmt.Sprint(sig))
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+var systemdSocket = flag.Bool("systemd-socket", false, "use the listening socket passed by systemd socket activation (LISTEN_FDS) instead of -listen/-exit-listen; falls back to them when not socket-activated")
+
+// sdListenFDsStart is the first file descriptor systemd passes, see
+// sd_listen_fds(3).
+const sdListenFDsStart = 3
+
+// systemdListener returns the first socket passed by systemd. ok is false
+// when the process was not socket-activated.
+func systemdListener() (ln net.Listener, ok bool, err error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, using the first one", n)
+	}
+	// Don't let anything we start think the sockets are meant for it.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err = net.FileListener(f)
+	if err != nil {
+		return nil, true, fmt.Errorf("systemd socket: %w", err)
+	}
+	return ln, true, nil
+}
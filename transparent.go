@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"mc-ws-proxy/proxy"
+)
+
+var transparent = flag.Bool("transparent", false, "on the entry (Linux only), treat player connections as redirected here by iptables REDIRECT/DNAT or TPROXY: log the address the player really connected to and send it to the exit in the "+origDstHeader+" header (not with -ws-pool-size or -mux)")
+
+///////////////////////
+//  入口机：透明代理（原始目标地址）
+///////////////////////
+
+// origDstHeader carries the player's original destination on the upgrade
+// request, for the exit's -dynamic-target.
+const origDstHeader = "X-Mcws-Original-Dst"
+
+func checkTransparent() error {
+	if !*transparent {
+		return nil
+	}
+	switch {
+	case !originalDstSupported:
+		return fmt.Errorf("-transparent needs Linux (SO_ORIGINAL_DST)")
+	case *wsPoolSize > 0:
+		return fmt.Errorf("-transparent does not work with -ws-pool-size: pooled connections are dialed before the destination is known")
+	case *muxEnabled:
+		return fmt.Errorf("-transparent does not work with -mux, whose session is shared by all destinations")
+	}
+	return nil
+}
+
+// transparentConn is a player connection whose LocalAddr is the address the
+// player dialed rather than the one it was redirected to.
+type transparentConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (c *transparentConn) LocalAddr() net.Addr { return c.dst }
+
+func (c *transparentConn) CloseWrite() error {
+	if cw, ok := c.Conn.(proxy.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// NetConn returns the redirected player connection itself.
+func (c *transparentConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// acceptTransparent finds where c was originally headed. A connection
+// conntrack has no entry for (TPROXY, or a player connecting to -listen
+// directly) was not rewritten, so its own local address already is the
+// destination and c is returned as is.
+func acceptTransparent(c net.Conn) net.Conn {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return c
+	}
+	dst, err := originalDst(tc)
+	if err != nil || !dst.IsValid() || dst == tc.LocalAddr().(*net.TCPAddr).AddrPort() {
+		return c
+	}
+	return &transparentConn{Conn: c, dst: net.TCPAddrFromAddrPort(dst)}
+}
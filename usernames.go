@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	parseHandshake     = flag.Bool("parse-handshake", false, "parse the Minecraft handshake on the entry (implied by the options that need it)")
+	usernameAllowFile  = flag.String("username-allowlist", "", "file with one Minecraft username per line; only these players may log in")
+	usernameDenyFile   = flag.String("username-denylist", "", "file with one Minecraft username per line; these players are refused")
+	usernameRejectText = flag.String("username-reject-message", "You are not allowed to join this server", "disconnect message shown to refused players")
+)
+
+// Loaded by loadUsernameLists; nil means the list is not configured.
+var usernameAllow, usernameDeny map[string]bool
+
+// handshakeEnabled reports whether the entry has to parse the start of the
+// player's stream before dialing the backend.
+func handshakeEnabled() bool {
+	return *parseHandshake || handshakeFilterEnabled() || *statusCacheTTL > 0 || *countAfterHandshake
+}
+
+// handshakeFilterEnabled reports whether players can be refused based on
+// the handshake, in which case one that cannot be parsed is refused too.
+func handshakeFilterEnabled() bool {
+	return usernameFilterEnabled() || protocolFilterEnabled()
+}
+
+func usernameFilterEnabled() bool {
+	return usernameAllow != nil || usernameDeny != nil
+}
+
+func loadUsernameLists() error {
+	var err error
+	if *usernameAllowFile != "" {
+		if usernameAllow, err = loadNameList(*usernameAllowFile); err != nil {
+			return err
+		}
+	}
+	if *usernameDenyFile != "" {
+		if usernameDeny, err = loadNameList(*usernameDenyFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadNameList reads one name per line. Blank lines and lines starting with
+// # are skipped; names are compared case-insensitively like Minecraft does.
+func loadNameList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names[strings.ToLower(line)] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return names, nil
+}
+
+func usernameAllowed(name string) bool {
+	name = strings.ToLower(name)
+	if usernameDeny[name] {
+		return false
+	}
+	if usernameAllow != nil && !usernameAllow[name] {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	webhookURL    = flag.String("webhook-url", "", "POST a JSON event to this URL when a connection starts bridging and when it ends (best effort, in the background)")
+	webhookSecret = flag.String("webhook-secret", "", "sign -webhook-url payloads with HMAC-SHA256 using this key, sent as X-Mcws-Signature: sha256=<hex>")
+)
+
+///////////////////////
+//  连接事件 Webhook（-webhook-url）
+///////////////////////
+
+const (
+	webhookQueueSize   = 256
+	webhookSendTimeout = 5 * time.Second
+)
+
+// webhookQueue is nil unless -webhook-url is set.
+var webhookQueue chan []byte
+
+// webhookDrops counts events dropped because the queue was full.
+var webhookDrops atomic.Uint64
+
+func initWebhook() error {
+	if *webhookURL == "" {
+		if *webhookSecret != "" {
+			return fmt.Errorf("-webhook-secret needs -webhook-url")
+		}
+		return nil
+	}
+	u, err := url.Parse(*webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-webhook-url must be an http:// or https:// URL, got %q", *webhookURL)
+	}
+	webhookQueue = make(chan []byte, webhookQueueSize)
+	go runWebhook()
+	log.Println("Sending connection events to", u.Host)
+	return nil
+}
+
+// webhookEvent is the JSON body of one delivery. The byte counts and
+// duration are 0 for "connect".
+type webhookEvent struct {
+	Event      string    `json:"event"` // "connect" or "disconnect"
+	Time       time.Time `json:"time"`
+	Instance   string    `json:"instance"`
+	Mode       string    `json:"mode"`
+	ConnID     uint64    `json:"conn_id"`
+	Remote     string    `json:"remote"`
+	RemoteIP   string    `json:"remote_ip"`
+	Backend    string    `json:"backend"`
+	BytesToWS  int64     `json:"bytes_to_ws"`
+	BytesToTCP int64     `json:"bytes_to_tcp"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"` // why the bridge ended, unless it was an ordinary close
+}
+
+// notifyConnect and notifyDisconnect queue an event for info. They never
+// block: when the queue is full the event is dropped and counted.
+func notifyConnect(info *connInfo) {
+	sendWebhook(newWebhookEvent("connect", info))
+}
+
+func notifyDisconnect(info *connInfo, err error) {
+	ev := newWebhookEvent("disconnect", info)
+	ev.BytesToWS = info.ToWS.Load()
+	ev.BytesToTCP = info.ToTCP.Load()
+	ev.DurationMS = time.Since(info.Start).Milliseconds()
+	if err != nil && unusualBridgeError(err) {
+		ev.Error = err.Error()
+	}
+	sendWebhook(ev)
+}
+
+func newWebhookEvent(event string, info *connInfo) *webhookEvent {
+	ip := info.Remote
+	if host, _, err := net.SplitHostPort(info.Remote); err == nil {
+		ip = host
+	}
+	return &webhookEvent{
+		Event:    event,
+		Time:     time.Now().UTC(),
+		Instance: metricsInstance,
+		Mode:     info.Mode,
+		ConnID:   info.ID,
+		Remote:   info.Remote,
+		RemoteIP: ip,
+		Backend:  info.Backend,
+	}
+}
+
+func sendWebhook(ev *webhookEvent) {
+	if webhookQueue == nil {
+		return
+	}
+	body, _ := json.Marshal(ev)
+	select {
+	case webhookQueue <- body:
+	default:
+		webhookDrops.Add(1)
+		if *debug {
+			log.Println("Webhook queue full, dropping", ev.Event, "event for conn", ev.ConnID)
+		}
+	}
+}
+
+func runWebhook() {
+	client := &http.Client{Timeout: webhookSendTimeout}
+	for body := range webhookQueue {
+		req, err := http.NewRequest(http.MethodPost, *webhookURL, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "mc-ws-proxy")
+		if *webhookSecret != "" {
+			mac := hmac.New(sha256.New, []byte(*webhookSecret))
+			mac.Write(body)
+			req.Header.Set("X-Mcws-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Println("Webhook:", err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Println("Webhook:", resp.Status)
+		}
+	}
+}
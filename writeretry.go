@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var writeTimeoutRetries = flag.Int("write-timeout-retries", 0, "WebSocket writes that time out may wait this many more write timeouts before the connection is given up; what was already sent is kept, so no data is repeated or lost (0 = fail on the first timeout)")
+
+///////////////////////
+//  WebSocket 写超时重试
+///////////////////////
+
+// retryConn sits under the WebSocket (below TLS) and lets a write that hits
+// its deadline carry on from where it stopped, with the deadline moved out
+// by the same amount again. gorilla and crypto/tls both treat a failed write
+// as fatal for the connection, so the retry has to happen here, before
+// either of them sees the error.
+//
+// Only the deadline the write started with is retried: if someone sets a
+// new one meanwhile (CloseWS pulls it in to unstick a write), the timeout is
+// returned as is.
+type retryConn struct {
+	net.Conn
+	tag     string
+	retries int
+
+	mu     sync.Mutex
+	gen    uint64        // bumped on every write deadline change
+	budget time.Duration // how far ahead the current write deadline was set
+}
+
+// wrapWriteRetry returns c wrapped for -write-timeout-retries, or c itself
+// when it is off.
+func wrapWriteRetry(c net.Conn, tag string) net.Conn {
+	if *writeTimeoutRetries <= 0 {
+		return c
+	}
+	return &retryConn{Conn: c, tag: tag, retries: *writeTimeoutRetries}
+}
+
+// retryListener applies wrapWriteRetry to every accepted connection.
+type retryListener struct {
+	net.Listener
+	tag string
+}
+
+func (l retryListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return wrapWriteRetry(c, l.tag), nil
+}
+
+func (c *retryConn) setBudget(t time.Time) {
+	c.mu.Lock()
+	c.gen++
+	c.budget = 0
+	if !t.IsZero() {
+		c.budget = time.Until(t)
+	}
+	c.mu.Unlock()
+}
+
+func (c *retryConn) SetDeadline(t time.Time) error {
+	c.setBudget(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *retryConn) SetWriteDeadline(t time.Time) error {
+	c.setBudget(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *retryConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	gen, budget := c.gen, c.budget
+	c.mu.Unlock()
+
+	written := 0
+	for try := 1; ; try++ {
+		n, err := c.Conn.Write(p[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() || try > c.retries || budget <= 0 {
+			return written, err
+		}
+		c.mu.Lock()
+		if c.gen != gen {
+			c.mu.Unlock()
+			return written, err
+		}
+		// Re-armed under mu, so a deadline set concurrently always wins.
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(budget))
+		c.mu.Unlock()
+		log.Printf("%s WS write to %s timed out with %d of %d bytes sent; retrying (%d/%d)", c.tag, c.RemoteAddr(), written, len(p), try, c.retries)
+	}
+}
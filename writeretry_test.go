@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallConn is a net.Conn whose writes are scripted: each call takes the
+// next step, accepting that many bytes and then timing out, or everything
+// once the steps run out. before, if set, runs at the start of each write.
+type stallConn struct {
+	net.Conn // nil; only the methods below are used
+	steps    []int
+	before   func(call int)
+
+	mu        sync.Mutex
+	calls     int
+	got       bytes.Buffer
+	deadlines []time.Time
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	call := c.calls
+	c.calls++
+	c.mu.Unlock()
+	if c.before != nil {
+		c.before(call)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if call < len(c.steps) {
+		n := min(c.steps[call], len(p))
+		c.got.Write(p[:n])
+		return n, os.ErrDeadlineExceeded
+	}
+	c.got.Write(p)
+	return len(p), nil
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *stallConn) RemoteAddr() net.Addr { return pipeAddr("backend") }
+
+func TestRetryConnResumesWithoutRepeating(t *testing.T) {
+	setFlag(t, writeTimeoutRetries, 2)
+	base := &stallConn{steps: []int{3000, 0}}
+	c := wrapWriteRetry(base, "[TEST]")
+
+	if err := c.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	n, err := c.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(base.got.Bytes(), data) {
+		t.Fatalf("peer got %d bytes, want the %d written exactly once", base.got.Len(), len(data))
+	}
+	if base.calls != 3 {
+		t.Errorf("%d writes to the conn, want 3 (two timeouts, then the rest)", base.calls)
+	}
+	// Ours, then one fresh deadline per retry.
+	if len(base.deadlines) != 3 {
+		t.Errorf("%d write deadlines set, want 3", len(base.deadlines))
+	}
+}
+
+func TestRetryConnGivesUpAfterRetries(t *testing.T) {
+	setFlag(t, writeTimeoutRetries, 1)
+	base := &stallConn{steps: []int{10, 10}}
+	c := wrapWriteRetry(base, "[TEST]")
+
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+	n, err := c.Write(make([]byte, 100))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 20 {
+		t.Fatalf("Write = %d, %v; want 20 and the timeout", n, err)
+	}
+}
+
+func TestRetryConnNewDeadlineWins(t *testing.T) {
+	setFlag(t, writeTimeoutRetries, 3)
+	base := &stallConn{steps: []int{100}}
+	c := wrapWriteRetry(base, "[TEST]")
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+
+	// While the first write is stuck, CloseWS pulls the deadline in.
+	closing := time.Now()
+	base.before = func(call int) {
+		if call == 0 {
+			done := make(chan struct{})
+			go func() {
+				_ = c.SetWriteDeadline(closing)
+				close(done)
+			}()
+			<-done
+		}
+	}
+	n, err := c.Write(make([]byte, 1000))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 100 {
+		t.Fatalf("Write = %d, %v; want 100 and the timeout", n, err)
+	}
+	if base.calls != 1 {
+		t.Errorf("%d writes to the conn, want no retry after the new deadline", base.calls)
+	}
+	if last := base.deadlines[len(base.deadlines)-1]; !last.Equal(closing) {
+		t.Errorf("last write deadline %v, want the one CloseWS set (%v)", last, closing)
+	}
+}